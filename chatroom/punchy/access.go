@@ -0,0 +1,374 @@
+package punchy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RoomAccess is what it takes to join a room. A room with neither a
+// password nor an allow-list is open to anyone who knows its name.
+type RoomAccess struct {
+	Password string
+	// Allow lists the public keys that may join. Empty allows any key.
+	Allow [][32]byte
+}
+
+func (a RoomAccess) protected() bool {
+	return a.Password != "" || len(a.Allow) > 0
+}
+
+func (a RoomAccess) allows(key [32]byte) bool {
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range a.Allow {
+		if hmac.Equal(allowed[:], key[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// challengeTimeout is how long a client has to answer a ROOM_CHALLENGE.
+const challengeTimeout = 10 * time.Second
+
+// maxChallenges caps the joins waiting on an answer, so a flood of
+// CONNECT_TO_ROOM cannot eat the server's memory.
+const maxChallenges = 4096
+
+// What a challenge asks the client to prove.
+const (
+	needPassword uint8 = 1 << iota
+	needKey
+)
+
+type RejectReason uint8
+
+const (
+	REJECT_PASSWORD      RejectReason = 1
+	REJECT_NOT_ALLOWED   RejectReason = 2
+	REJECT_NO_CHALLENGE  RejectReason = 3
+	REJECT_BUSY          RejectReason = 4
+	REJECT_BAD_SIGNATURE RejectReason = 5
+	REJECT_BAD_NICK      RejectReason = 6
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case REJECT_PASSWORD:
+		return "wrong password"
+	case REJECT_NOT_ALLOWED:
+		return "your key is not on the allow-list"
+	case REJECT_NO_CHALLENGE:
+		return "the challenge expired, try again"
+	case REJECT_BUSY:
+		return "the server is busy, try again"
+	case REJECT_BAD_SIGNATURE:
+		return "your join was not signed by your identity key"
+	case REJECT_BAD_NICK:
+		return "nicknames are 1 to 32 printable characters with no spaces"
+	}
+	return "refused"
+}
+
+// RoomRejectedError is reported on Errors when the server turns down a join.
+type RoomRejectedError struct {
+	Room   string
+	Reason RejectReason
+}
+
+func (e *RoomRejectedError) Error() string {
+	return fmt.Sprintf("Not allowed into %s: %v", e.Room, e.Reason)
+}
+
+// RoomChallengeMessage asks a client joining a protected room to prove it
+// may. Needs says which proofs are wanted, and Key is the server's public
+// key for the key proof.
+type RoomChallengeMessage struct {
+	RoomMessage
+	Nonce [32]byte
+	Needs uint8
+	Key   [32]byte
+}
+
+// RoomResponseMessage answers a challenge. Each proof is an HMAC-SHA256 of
+// the nonce, room and the client's public key: keyed by the room password
+// and the key the client shares with the server for Password, and by the
+// shared key alone for Key.
+// A proof that was not asked for is left zero.
+type RoomResponseMessage struct {
+	RoomMessage
+	Nonce    [32]byte
+	Password [32]byte
+	Key      [32]byte
+}
+
+// RoomRejectedMessage tells a client it has not been let into a room.
+type RoomRejectedMessage struct {
+	RoomMessage
+	Reason RejectReason
+}
+
+func (m *RoomChallengeMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putKey(m.Nonce)
+	w.putUint8(m.Needs)
+	w.putKey(m.Key)
+	return w.bytes()
+}
+
+func (m *RoomChallengeMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Nonce = r.getKey()
+	m.Needs = r.getUint8()
+	m.Key = r.getKey()
+	return r.done()
+}
+
+func (m *RoomResponseMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putKey(m.Nonce)
+	w.putKey(m.Password)
+	w.putKey(m.Key)
+	return w.bytes()
+}
+
+func (m *RoomResponseMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Nonce = r.getKey()
+	m.Password = r.getKey()
+	m.Key = r.getKey()
+	return r.done()
+}
+
+func (m *RoomRejectedMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint8(uint8(m.Reason))
+	return w.bytes()
+}
+
+func (m *RoomRejectedMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Reason = RejectReason(r.getUint8())
+	return r.done()
+}
+
+// passwordKey turns a room password into an HMAC key. The key the client
+// shares with the server goes in too, so someone who sees a challenge and
+// its answer cannot test guesses at the password against them.
+func passwordKey(roomName, password string, shared [32]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("lemony room password"))
+	h.Write(shared[:])
+	h.Write([]byte(roomName))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func roomProof(key []byte, nonce [32]byte, roomName string, public [32]byte) [32]byte {
+	var proof [32]byte
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce[:])
+	mac.Write([]byte(roomName))
+	mac.Write(public[:])
+	copy(proof[:], mac.Sum(nil))
+	return proof
+}
+
+// roomChallenge is a join waiting for its answer.
+type roomChallenge struct {
+	join    ConnectRoomMessage
+	nonce   [32]byte
+	needs   uint8
+	expires time.Time
+}
+
+func challengeKey(addr *net.UDPAddr, roomName string) string {
+	return addr.String() + "/" + roomName
+}
+
+// challenge asks a client to prove it may join a protected room. A key
+// that is not on the allow-list is turned away without one.
+func (s *Server) challenge(sender *net.UDPAddr, join ConnectRoomMessage, access RoomAccess) error {
+	if !access.allows(join.sharedKey) {
+		return s.reject(sender, join.Room, REJECT_NOT_ALLOWED)
+	}
+	var needs uint8
+	if access.Password != "" {
+		needs |= needPassword
+	}
+	if len(access.Allow) > 0 {
+		needs |= needKey
+	}
+	pending := &roomChallenge{join: join, needs: needs, expires: time.Now().Add(challengeTimeout)}
+	_, err := rand.Read(pending.nonce[:])
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	now := time.Now()
+	for key, old := range s.challenges {
+		if now.After(old.expires) {
+			delete(s.challenges, key)
+		}
+	}
+	busy := len(s.challenges) >= maxChallenges
+	if !busy {
+		s.challenges[challengeKey(sender, join.Room)] = pending
+	}
+	s.lock.Unlock()
+	if busy {
+		return s.reject(sender, join.Room, REJECT_BUSY)
+	}
+
+	challenge := RoomChallengeMessage{RoomMessage{join.Room}, pending.nonce, needs, s.keys.Public}
+	payload, err := challenge.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, ROOM_CHALLENGE, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return s.send(data, sender)
+}
+
+// RoomResponseReceived checks the answer to a challenge and lets the client
+// in if every proof asked for is right.
+func (s *Server) RoomResponseReceived(message Message) error {
+	var response RoomResponseMessage
+	err := response.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	sender := message.Sender()
+	key := challengeKey(sender, response.Room)
+	s.lock.Lock()
+	pending := s.challenges[key]
+	delete(s.challenges, key)
+	s.lock.Unlock()
+	if pending == nil || time.Now().After(pending.expires) || !hmac.Equal(pending.nonce[:], response.Nonce[:]) {
+		return s.reject(sender, response.Room, REJECT_NO_CHALLENGE)
+	}
+	join := pending.join
+	access := s.Access[join.Room]
+	shared, err := s.keys.SharedKey(join.sharedKey)
+	if err != nil {
+		return err
+	}
+	if pending.needs&needPassword != 0 {
+		want := roomProof(passwordKey(join.Room, access.Password, shared), pending.nonce, join.Room, join.sharedKey)
+		if !hmac.Equal(want[:], response.Password[:]) {
+			log.Warningf("%v gave the wrong password for %s", sender, join.Room)
+			return s.reject(sender, join.Room, REJECT_PASSWORD)
+		}
+	}
+	if pending.needs&needKey != 0 {
+		want := roomProof(shared[:], pending.nonce, join.Room, join.sharedKey)
+		if !access.allows(join.sharedKey) || !hmac.Equal(want[:], response.Key[:]) {
+			log.Warningf("%v could not prove it holds an allowed key for %s", sender, join.Room)
+			return s.reject(sender, join.Room, REJECT_NOT_ALLOWED)
+		}
+	}
+	s.admit(sender, join)
+	return nil
+}
+
+func (s *Server) reject(client *net.UDPAddr, roomName string, reason RejectReason) error {
+	log.Infof("Rejecting %v from %s: %v", client, roomName, reason)
+	rejected := RoomRejectedMessage{RoomMessage{roomName}, reason}
+	payload, err := rejected.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, ROOM_REJECTED, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return s.send(data, client)
+}
+
+// SetRoomPassword sets the password we answer a room's challenge with.
+// Set it before joining.
+func (c *Client) SetRoomPassword(roomName, password string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.passwords[roomName] = password
+}
+
+// RoomChallengeReceived proves to the server that we may join a room, with
+// whichever of our password and key it asked for.
+func (c *Client) RoomChallengeReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var challenge RoomChallengeMessage
+	err := challenge.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	_, joining := c.rooms[challenge.Room]
+	password := c.passwords[challenge.Room]
+	c.lock.Unlock()
+	if !joining {
+		return NotInRoomError
+	}
+	shared, err := c.keys.SharedKey(challenge.Key)
+	if err != nil {
+		return err
+	}
+	response := RoomResponseMessage{RoomMessage: RoomMessage{challenge.Room}, Nonce: challenge.Nonce}
+	if challenge.Needs&needPassword != 0 {
+		response.Password = roomProof(passwordKey(challenge.Room, password, shared), challenge.Nonce, challenge.Room, c.keys.Public)
+	}
+	if challenge.Needs&needKey != 0 {
+		response.Key = roomProof(shared[:], challenge.Nonce, challenge.Room, c.keys.Public)
+	}
+	payload, err := response.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	reply := &Message{RawMessage{nil, payload}, ROOM_RESPONSE, false, uint16(len(payload))}
+	data, err := reply.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, c.middleMan)
+	return err
+}
+
+// RoomRejectedReceived forgets a room the server would not let us into and
+// reports why on Errors.
+func (c *Client) RoomRejectedReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var rejected RoomRejectedMessage
+	err := rejected.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	delete(c.rooms, rejected.Room)
+	delete(c.roomNicks, rejected.Room)
+	delete(c.tokens, rejected.Room)
+	c.forgetActivity(rejected.Room)
+	c.lock.Unlock()
+	c.reportError(&RoomRejectedError{rejected.Room, rejected.Reason})
+	return nil
+}
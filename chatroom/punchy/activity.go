@@ -0,0 +1,261 @@
+package punchy
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// typingInterval is the least time between two typing signals to a room,
+// however fast the user types.
+const typingInterval = 3 * time.Second
+
+// TypingEvent is a peer typing in a room. Stopped is set once the message
+// they were typing arrives.
+type TypingEvent struct {
+	Room    string
+	Peer    string
+	Stopped bool
+}
+
+// Receipt says a peer has read everything we sent to a room, up to and
+// including the message with ID.
+type Receipt struct {
+	Room string
+	Peer string
+	ID   uint32
+}
+
+// ReadMessage is sent as a READ_RECEIPT to tell a peer we have read what
+// they sent up to and including ID. A TYPING signal is a bare RoomMessage.
+// Both are sealed with the key we share with the peer, and in both an
+// empty Room means our private conversation with them.
+type ReadMessage struct {
+	RoomMessage
+	ID uint32
+}
+
+func (m *ReadMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint32(m.ID)
+	return w.bytes()
+}
+
+func (m *ReadMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.ID = r.getUint32()
+	return r.done()
+}
+
+// readMark is the newest message a peer has sent us in a room.
+type readMark struct {
+	addr net.UDPAddr
+	id   uint32
+}
+
+// readKey is what read marks are kept under: one per peer in each room.
+type readKey struct {
+	room string
+	addr string
+}
+
+// wireRoom is the room to name in a signal: none for a private
+// conversation, which is implied by who it is sent to.
+func wireRoom(roomName string) string {
+	if strings.HasPrefix(roomName, "@") {
+		return ""
+	}
+	return roomName
+}
+
+// SendTyping tells a room, or the peer in a private conversation, that we
+// are typing. Calling it on every keystroke is fine: at most one signal
+// goes out per typingInterval.
+func (c *Client) SendTyping(roomName string) error {
+	c.lock.Lock()
+	if time.Since(c.typingSent[roomName]) < typingInterval {
+		c.lock.Unlock()
+		return nil
+	}
+	c.typingSent[roomName] = time.Now()
+	c.lock.Unlock()
+	typing := RoomMessage{wireRoom(roomName)}
+	payload, err := typing.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	for _, peer := range c.signalPeers(roomName) {
+		err := c.sendSignal(&peer, TYPING, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkRead tells each peer in a room that we have read everything they
+// have sent there so far. Peers we have already told hear nothing.
+func (c *Client) MarkRead(roomName string) error {
+	c.lock.Lock()
+	unread := make([]readMark, 0)
+	for key, mark := range c.received {
+		if key.room == roomName && c.readSent[key] != mark.id {
+			c.readSent[key] = mark.id
+			unread = append(unread, mark)
+		}
+	}
+	c.lock.Unlock()
+	for _, mark := range unread {
+		peer := c.findPeer(&mark.addr)
+		if peer == nil {
+			continue
+		}
+		read := ReadMessage{RoomMessage{wireRoom(roomName)}, mark.id}
+		payload, err := read.EncodeMessage()
+		if err != nil {
+			return err
+		}
+		err = c.sendSignal(peer, READ_RECEIPT, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signalPeers is who a signal for a room goes to.
+func (c *Client) signalPeers(roomName string) []Peer {
+	if !strings.HasPrefix(roomName, "@") {
+		return c.Peers(roomName)
+	}
+	peerName := strings.TrimPrefix(roomName, "@")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peers := range c.rooms {
+		for _, peer := range peers {
+			if peer.Name() == peerName {
+				return []Peer{peer}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) sendSignal(peer *Peer, msgType MessageType, payload []byte) error {
+	if peer.state == PeerFailed || peer.sharedKey == [32]byte{} {
+		return nil
+	}
+	sealed, err := Seal(peer.sharedKey, payload)
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, sealed}, msgType, true, uint16(len(sealed))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.sendToPeer(peer, data)
+	return err
+}
+
+// noteReceived remembers the newest message a peer has sent to a room, for
+// MarkRead, and that they have stopped typing it.
+func (c *Client) noteReceived(roomName string, peer *Peer, id uint32) {
+	c.lock.Lock()
+	key := readKey{roomName, peer.UDPAddr.String()}
+	if mark, ok := c.received[key]; !ok || id > mark.id {
+		c.received[key] = readMark{peer.UDPAddr, id}
+	}
+	c.lock.Unlock()
+	c.reportTyping(TypingEvent{roomName, peer.Name(), true})
+}
+
+// forgetActivity drops the typing and read marks for a room we have left.
+// The caller must hold c.lock.
+func (c *Client) forgetActivity(roomName string) {
+	delete(c.typingSent, roomName)
+	for key := range c.received {
+		if key.room == roomName {
+			delete(c.received, key)
+			delete(c.readSent, key)
+		}
+	}
+}
+
+// ActivityReceived handles a peer's typing signal or read receipt.
+func (c *Client) ActivityReceived(message Message) error {
+	if !message.Encrypted() {
+		return DecryptionError
+	}
+	peer := c.findPeer(message.Sender())
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	plaintext, err := Open(peer.sharedKey, message.Data)
+	if err != nil {
+		return err
+	}
+	var roomName string
+	var read ReadMessage
+	if message.Type() == TYPING {
+		var typing RoomMessage
+		err = typing.DecodeMessage(plaintext)
+		roomName = typing.Room
+	} else {
+		err = read.DecodeMessage(plaintext)
+		roomName = read.Room
+	}
+	if err != nil {
+		return err
+	}
+	if roomName == "" {
+		roomName = DirectRoom(peer.Name())
+	} else if !c.inRoom(roomName, message.Sender()) {
+		return NotInRoomError
+	}
+	if message.Type() == TYPING {
+		c.reportTyping(TypingEvent{roomName, peer.Name(), false})
+	} else {
+		c.reportReceipt(Receipt{roomName, peer.Name(), read.ID})
+	}
+	return nil
+}
+
+// inRoom reports whether we and the peer at addr are both in a room.
+func (c *Client) inRoom(roomName string, addr *net.UDPAddr) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peer := range c.rooms[roomName] {
+		if peer.UDPAddr.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Typing carries peers starting and stopping typing.
+func (c *Client) Typing() chan TypingEvent {
+	return c.typingChannel
+}
+
+// Receipts carries peers' read receipts for what we sent.
+func (c *Client) Receipts() chan Receipt {
+	return c.receiptChannel
+}
+
+func (c *Client) reportTyping(typing TypingEvent) {
+	select {
+	case c.typingChannel <- typing:
+	default:
+	}
+}
+
+func (c *Client) reportReceipt(receipt Receipt) {
+	select {
+	case c.receiptChannel <- receipt:
+	default:
+		log.Warning("Receipt channel full, dropping read receipt")
+	}
+}
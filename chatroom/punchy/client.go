@@ -1,200 +1,835 @@
 package punchy
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+const middleManTimeout = 2 * time.Second
+const middleManRetries = 3
+
+// MAX_NICK_LENGTH is the longest nickname we will ask for, in characters.
+const MAX_NICK_LENGTH = 32
+
+// MAX_ROOM_NAME_LENGTH is the longest room name, in characters.
+const MAX_ROOM_NAME_LENGTH = 64
+
+var MiddleManTimeoutError = errors.New("No response from middle man")
+var PeerNotFoundError = errors.New("No such peer in room")
+var InvalidNickError = errors.New("Nicknames are 1 to 32 printable characters with no spaces")
+var InvalidRoomNameError = errors.New("Room names are 1 to 64 printable characters with no spaces, not starting with @")
+
 type ClientInter interface {
 	ConnectToRoom(io.Reader, string)
 	ConnectToServer(*net.UDPAddr)
 }
 
+// DisplayMessage is a line of text for the UI, tagged with the room it
+// belongs in.
+type DisplayMessage struct {
+	Room string
+	Text string
+}
+
 type Peer struct {
 	net.UDPAddr
-	name string
+	name      string
+	publicKey [32]byte
+	sharedKey [32]byte
+	identity  [32]byte
+	trust     Trust
+	state     PeerState
+	rtt       time.Duration
+	lastSeen  time.Time
 }
 
 type Client struct {
-	inputChannel  chan string
-	clientChannel chan InboundMessage
-	errorChannel  chan error
-	middleMan     *net.UDPAddr
-	conn          *net.UDPConn
-	rooms         map[string][]Peer
+	// lock guards rooms, roomNicks, tokens, passwords, nick, heartbeat, the
+	// typing and read marks and our registration, which the read goroutine
+	// changes while the UI and senders use them.
+	lock            sync.Mutex
+	inputChannel    chan string
+	clientChannel   chan InboundMessage
+	errorChannel    chan error
+	middleMan       *net.UDPAddr
+	conn            *net.UDPConn
+	rooms           map[string][]Peer
+	registered      chan MiddleManMessage
+	publicAddress   *net.UDPAddr
+	sessionID       uint32
+	keys            *KeyPair
+	identity        ed25519.PrivateKey
+	known           *KnownPeers
+	displayChannel  chan DisplayMessage
+	relayAvailable  bool
+	shareHistory    bool
+	historyKey      *[32]byte
+	historyChannel  chan DisplayMessage
+	nick            string
+	roomNicks       map[string]string
+	tokens          map[string][32]byte
+	passwords       map[string]string
+	reliable        *reliability
+	heartbeat       time.Duration
+	started         time.Time
+	deliveryChannel chan Delivery
+	membersChannel  chan string
+	typingSent      map[string]time.Time
+	received        map[readKey]readMark
+	readSent        map[readKey]uint32
+	typingChannel   chan TypingEvent
+	receiptChannel  chan Receipt
+	fragments       *reassembler
+	transfers       *transfers
+	dropped         uint64
+	life            *lifecycle
 }
 
-func (c *Client) errorHandler() {
-	err := <-c.errorChannel
-	panic(err)
-}
-
-func NewClient(hostname string, port *int) *Client {
+func NewClient(hostname string, port *int) (*Client, error) {
 	addressString := fmt.Sprintf(hostname+":%v", *port)
 	s, err := net.ResolveUDPAddr("udp", addressString)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	cAddr, err := net.ResolveUDPAddr("udp", ":")
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	keys, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := NewIdentity()
+	if err != nil {
+		return nil, err
 	}
 	c, err := net.ListenUDP("udp", cAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	growReadBuffer(c)
 
 	client := &Client{
-		make(chan string),
-		make(chan InboundMessage),
-		make(chan error),
-		s, c,
-		make(map[string][]Peer),
+		inputChannel:    make(chan string),
+		clientChannel:   make(chan InboundMessage),
+		errorChannel:    make(chan error, 16),
+		middleMan:       s,
+		conn:            c,
+		rooms:           make(map[string][]Peer),
+		roomNicks:       make(map[string]string),
+		tokens:          make(map[string][32]byte),
+		passwords:       make(map[string]string),
+		registered:      make(chan MiddleManMessage, 1),
+		historyChannel:  make(chan DisplayMessage, HISTORY_REQUEST_SIZE),
+		keys:            keys,
+		identity:        identity,
+		known:           newKnownPeers(),
+		heartbeat:       DEFAULT_HEARTBEAT,
+		started:         time.Now(),
+		deliveryChannel: make(chan Delivery, 64),
+		membersChannel:  make(chan string, 64),
+		typingSent:      make(map[string]time.Time),
+		received:        make(map[readKey]readMark),
+		readSent:        make(map[readKey]uint32),
+		typingChannel:   make(chan TypingEvent, 64),
+		receiptChannel:  make(chan Receipt, 64),
+		fragments:       newReassembler(),
+		transfers:       newTransfers(),
+		life:            newLifecycle(),
 	}
-	go client.errorHandler()
-	return client
+	return client, nil
+}
 
+// ConnectToRoom registers with the middle man if we have not already, then
+// asks to join the room. Messages for the room are sent with the channel
+// given to StartUp. The room's history is asked for once we are let in.
+func (c *Client) ConnectToRoom(roomName string) error {
+	if !validRoomName(roomName) {
+		return InvalidRoomNameError
+	}
+	if c.SessionID() == 0 {
+		err := c.ConnectToMiddleMan()
+		if err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	if c.rooms[roomName] == nil {
+		c.rooms[roomName] = make([]Peer, 0)
+	}
+	c.lock.Unlock()
+	err := c.announce(roomName)
+	if err != nil {
+		return err
+	}
+	log.Info("Join room")
+	log.Infof("Listening on...%v", c.conn.LocalAddr())
+	return nil
 }
 
-func (c *Client) ConnectToRoom(inputStream chan string, roomName string) {
-	// Continous Read & Writes.
-	roomMessage := RoomMessage{roomName}
+// announce sends the server our key and nickname for a room. Sending it
+// again for a room we are already in updates our nickname there.
+func (c *Client) announce(roomName string) error {
+	roomMessage := ConnectRoomMessage{RoomMessage: RoomMessage{roomName}, sharedKey: c.keys.Public, Name: c.Nick()}
+	signJoin(c.identity, &roomMessage)
 	raw, err := roomMessage.RawMessage()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	message := &Message{raw, CONNECT_TO_ROOM, false, uint16(len(raw.Data))}
 	data, err := message.EncodeMessage()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	c.conn.WriteTo(data, c.middleMan)
-	log.Info("Join room")
+	_, err = c.conn.WriteToUDP(data, c.middleMan)
+	return err
+}
+
+// LeaveRoom tells the server we are leaving so the other members hear about
+// it straight away, rather than when we stop answering pings.
+func (c *Client) LeaveRoom(roomName string) error {
+	c.lock.Lock()
+	delete(c.rooms, roomName)
+	delete(c.roomNicks, roomName)
+	delete(c.tokens, roomName)
+	c.forgetActivity(roomName)
+	c.lock.Unlock()
+	c.forgetReliable()
+	log.Infof("Left room %s", roomName)
+	roomMessage := RoomMessage{roomName}
+	raw, err := roomMessage.RawMessage()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	room := c.rooms[roomName]
-	if room != nil {
-		room = make([]Peer, 10)
+	message := &Message{raw, DISCONNECT_FROM_ROOM, false, uint16(len(raw.Data))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
 	}
-	c.rooms[roomName] = room
-	log.Infof("Listening on...%v", c.conn.LocalAddr())
+	_, err = c.conn.WriteToUDP(data, c.middleMan)
+	return err
+}
 
-	go c.ClientContiniousWrite(inputStream, roomName)
-	panic(<-c.errorChannel)
+func (c *Client) Rooms() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	names := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		names = append(names, name)
+	}
+	return names
 }
 
-func (c *Client) ConnectToMiddleMan() {
+// ConnectToMiddleMan registers with the rendezvous server and waits for it
+// to tell us our public address and session. StartUp must already be running
+// so the response can be read.
+func (c *Client) ConnectToMiddleMan() error {
+	message := &Message{RawMessage{nil, make([]byte, 0)}, CONNECT_TO_MIDDLE_MAN, false, 0}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < middleManRetries; i++ {
+		_, err = c.conn.WriteToUDP(data, c.middleMan)
+		if err != nil {
+			return err
+		}
+		select {
+		case response := <-c.registered:
+			c.lock.Lock()
+			c.publicAddress = &response.PublicAddress
+			c.sessionID = response.SessionID
+			c.relayAvailable = response.Relay
+			c.lock.Unlock()
+			log.Infof("Registered as %v with session %d", &response.PublicAddress, response.SessionID)
+			return nil
+		case <-time.After(middleManTimeout):
+			log.Warningf("Middle man did not respond, attempt %d", i+1)
+		case <-c.life.done():
+			return ClosedError
+		}
+	}
+	return MiddleManTimeoutError
+}
 
+func (c *Client) RegisterResponse(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var response MiddleManMessage
+	err := response.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.registered <- response:
+	default:
+	}
+	return nil
 }
 
-func (c *Client) StartUp(displayChan chan string) {
-	go c.ClientContiniousRead()
-	go c.Display(displayChan)
+// PublicKey is the key peers and the server know us by.
+func (c *Client) PublicKey() [32]byte {
+	return c.keys.Public
 }
 
-func (c *Client) Display(displayChan chan string) {
+// SetKeyPair replaces the key pair made by NewClient, for instance with one
+// from LoadKeyPair. Call it before joining any rooms.
+func (c *Client) SetKeyPair(keys *KeyPair) {
+	c.keys = keys
+}
+
+func (c *Client) PublicAddress() *net.UDPAddr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.publicAddress
+}
+
+func (c *Client) SessionID() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sessionID
+}
+
+func (c *Client) RelayAvailable() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.relayAvailable
+}
+
+// StartUp starts reading from the network, sending whatever arrives on
+// messageChan and showing chat on displayChan. It returns straight away;
+// Close stops it all again.
+func (c *Client) StartUp(displayChan chan DisplayMessage, messageChan chan ChatMessage) {
+	c.displayChannel = displayChan
+	c.life.spawn(c.ClientContiniousRead)
+	c.life.spawn(func() { c.ClientContiniousWrite(messageChan) })
+	c.life.spawn(func() { c.Display(displayChan) })
+	c.life.spawn(c.Heartbeat)
+	c.life.spawn(c.sweepFragments)
+}
+
+// Run is StartUp for callers that want to block. It returns once ctx is
+// cancelled or Close is called, with everything shut down.
+func (c *Client) Run(ctx context.Context, displayChan chan DisplayMessage, messageChan chan ChatMessage) error {
+	c.StartUp(displayChan, messageChan)
+	select {
+	case <-ctx.Done():
+	case <-c.life.done():
+	}
+	return c.Close()
+}
+
+// Close stops every goroutine the client started, waits for them to
+// finish and closes the socket. Anything still waiting to be displayed is
+// dropped. Closing twice is harmless.
+func (c *Client) Close() error {
+	return c.life.stop(c.conn.Close)
+}
+
+// Done is closed once the client starts shutting down.
+func (c *Client) Done() <-chan struct{} {
+	return c.life.done()
+}
+
+func (c *Client) Display(displayChan chan DisplayMessage) {
 	for {
-		message := <-c.clientChannel
-		if message.Type() == ROOM_MESSAGE {
+		var message InboundMessage
+		select {
+		case message = <-c.clientChannel:
+		case <-c.life.done():
+			return
+		}
+		if message.Type() == ROOM_MESSAGE || message.Type() == PRIVATE_MESSAGE {
+			if !message.Encrypted() {
+				c.dropPacket(message, DecryptionError)
+				continue
+			}
+			peer := c.findPeer(message.Sender())
+			if peer == nil {
+				c.dropPacket(message, PeerNotFoundError)
+				continue
+			}
+			key := peer.sharedKey
+			if message.Type() == PRIVATE_MESSAGE {
+				key = PrivateKey(peer.sharedKey)
+			}
+			plaintext, err := Open(key, message.RawData())
+			if err != nil {
+				c.dropPacket(message, err)
+				continue
+			}
 			var chatMessage ChatMessage
-			err := chatMessage.DecodeMessage(message.RawData())
+			err = chatMessage.DecodeMessage(plaintext)
 			if err != nil {
-				log.Error(err)
+				c.dropPacket(message, err)
+				continue
 			}
 			log.Infof("Display coroutine decoding message")
-			displayChan <- fmt.Sprintf("%v says \"%v\" to room %v", message.Sender(), chatMessage.Message, chatMessage.Room)
-			log.Infof("Dropped to dispaly chan %v", message)
+			name := peer.name
+			if name == "" {
+				name = peer.Name()
+				if chatMessage.Name != "" {
+					name = chatMessage.Name
+				}
+			}
+			roomName := chatMessage.Room
+			if message.Type() == PRIVATE_MESSAGE {
+				roomName = DirectRoom(peer.Name())
+			} else if !c.inRoom(roomName, message.Sender()) {
+				// The room is theirs to name, so a peer could otherwise
+				// post into a room they were never let into, or open a tab
+				// that looks like a direct message.
+				c.dropPacket(message, NotInRoomError)
+				continue
+			}
+			c.noteReceived(roomName, peer, chatMessage.ID)
+			select {
+			case displayChan <- DisplayMessage{roomName, FormatChat(name, chatMessage.Message)}:
+				log.Infof("Dropped to dispaly chan %v", message)
+			case <-c.life.done():
+				return
+			}
 		}
 	}
 }
 
+func (c *Client) notify(roomName, text string) {
+	if c.displayChannel != nil {
+		select {
+		case c.displayChannel <- DisplayMessage{roomName, text}:
+		case <-c.life.done():
+		}
+	}
+}
+
+// ClientContiniousRead reads datagrams until the socket is closed. Anything
+// that cannot be decoded or handled is dropped and counted; one bad packet
+// never stops the loop.
 func (c *Client) ClientContiniousRead() {
 	buf := make([]byte, MAX_UDP_DATAGRAM)
 	for {
 		n, sender, err := c.conn.ReadFromUDP(buf)
-		var message Message
-		message.RawMessage.Sender = sender
-		message.DecodeMessage(sender, buf[:n])
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			c.reportError(err)
+			continue
+		}
 		log.Infof("Got message from %v", sender)
-		if n > 0 && err == nil {
-			if message.Type() == PING {
-				log.Infof("Pong recieved from %v", sender)
-				c.Pong()
-			} else if message.Type() == ROOM_MESSAGE {
-				log.Infof("Room message %v", sender)
-				c.clientChannel <- &message
-			} else if message.Type() == ROOM_LIST {
-				log.Infof("Room list from %v", sender)
-				c.UpdateRoomList(message)
-			}
-
+		var message Message
+		err = message.DecodeMessage(sender, buf[:n])
+		if versionErr, ok := err.(*VersionError); ok {
+			log.Warningf("%v: %v", sender, versionErr)
+			c.conn.WriteToUDP(versionMismatch, sender)
+			continue
 		} else if err != nil {
-			log.Infof("Error %v", err)
-			c.errorChannel <- err
+			c.dropPacket(&message, err)
+			continue
+		}
+		err = c.handleMessage(message)
+		if err != nil {
+			c.dropPacket(&message, err)
 		}
 	}
 }
 
-func (c *Client) Pong() {
-	m := &Message{RawMessage{nil, make([]byte, 0)}, PONG, false, 0}
-	data, err := m.EncodeMessage()
-	if err != nil {
-		panic(err)
+func (c *Client) handleMessage(message Message) error {
+	sender := message.Sender()
+	if message.Type() == PING {
+		return c.PingReceived(message)
+	} else if message.Type() == ROOM_MESSAGE || message.Type() == PRIVATE_MESSAGE {
+		log.Infof("Chat message %v", sender)
+		c.sawPeer(sender, 0)
+		select {
+		case c.clientChannel <- &message:
+		case <-c.life.done():
+		}
+		return nil
+	} else if message.Type() == RESPOND_TO_MIDDLE_MAN {
+		log.Infof("Middle man response from %v", sender)
+		return c.RegisterResponse(message)
+	} else if message.Type() == ROOM_LIST {
+		log.Infof("Room list from %v", sender)
+		return c.UpdateRoomList(message)
+	} else if message.Type() == PUNCH_SCHEDULE {
+		log.Infof("Punch schedule from %v", sender)
+		return c.PunchScheduled(message)
+	} else if message.Type() == PUNCH || message.Type() == PUNCH_ACK {
+		return c.PunchReceived(message)
+	} else if message.Type() == ROOM_HISTORY {
+		log.Infof("Room history from %v", sender)
+		return c.HistoryReceived(message)
+	} else if message.Type() == VERSION_MISMATCH {
+		version, err := message.MismatchedVersion()
+		if err != nil {
+			return err
+		}
+		log.Errorf("%v speaks protocol version %d, we speak %d", sender, version, PROTOCOL_VERSION)
+		c.notify("", fmt.Sprintf("%v cannot talk to us, it speaks protocol version %d and we speak %d", sender, version, PROTOCOL_VERSION))
+		return nil
+	} else if message.Type() == RELAY_MESSAGE {
+		log.Infof("Relayed message from %v", sender)
+		return c.RelayReceived(message)
+	} else if message.Type() == RELIABLE_MESSAGE {
+		return c.ReliableReceived(message)
+	} else if message.Type() == ACK {
+		return c.AckReceived(message)
+	} else if message.Type() == FRAGMENT {
+		return c.FragmentReceived(message)
+	} else if message.Type() == FILE_OFFER {
+		return c.FileOfferReceived(message)
+	} else if message.Type() == FILE_ACCEPT {
+		return c.FileAcceptReceived(message)
+	} else if message.Type() == FILE_REJECT {
+		return c.FileRejectReceived(message)
+	} else if message.Type() == FILE_CHUNK {
+		return c.FileChunkReceived(message)
+	} else if message.Type() == ROOM_CHALLENGE {
+		return c.RoomChallengeReceived(message)
+	} else if message.Type() == ROOM_REJECTED {
+		return c.RoomRejectedReceived(message)
+	} else if message.Type() == PRESENCE {
+		return c.PresenceReceived(message)
+	} else if message.Type() == HEARTBEAT || message.Type() == HEARTBEAT_ACK {
+		return c.HeartbeatReceived(message)
+	} else if message.Type() == TYPING || message.Type() == READ_RECEIPT {
+		return c.ActivityReceived(message)
 	}
-	c.conn.WriteToUDP(data, c.middleMan)
+	return UnknownMessageError
 }
 
-func (c *Client) ClientContiniousWrite(messageChan chan string, roomName string) {
+// ClientContiniousWrite sends each message to every peer in the room it is
+// addressed to.
+func (c *Client) ClientContiniousWrite(messageChan chan ChatMessage) {
 	for {
-		text := <-messageChan
-
-		for _, client := range c.rooms[roomName] {
-			roomMes := &ChatMessage{RoomMessage{roomName}, text}
-			roomData, err := roomMes.EncodeMessage()
+		var chatMessage ChatMessage
+		select {
+		case chatMessage = <-messageChan:
+		case <-c.life.done():
+			return
+		}
+		chatMessage.Name = c.RoomNick(chatMessage.Room)
+		peers := c.Peers(chatMessage.Room)
+		for i := range peers {
+			err := c.sendChat(&peers[i], &chatMessage, ROOM_MESSAGE)
 			if err != nil {
-				panic(err)
+				c.reportError(err)
 			}
-			sendMe := Message{RawMessage{nil, roomData}, ROOM_MESSAGE, false, uint16(len(roomData))}
-			data, err := sendMe.EncodeMessage()
+		}
+		if share, _ := c.historyOptions(); share {
+			err := c.sendHistoryCopy(chatMessage.Room, &chatMessage)
 			if err != nil {
-				panic(err)
+				c.reportError(err)
 			}
-			n, err := c.conn.WriteToUDP(data, &client.UDPAddr)
-			if n > 0 && err == nil {
-				log.Infof("Sent to %v", client)
-			} else if err != nil {
-				log.Critical(err)
-				c.errorChannel <- err
+		}
+	}
+}
+
+// SendPrivate sends a private message to one peer, in whichever room we
+// share with them. The peer is picked by name, or by address if they have
+// no name. Deliveries for it are reported against the room DirectRoom(peerName).
+func (c *Client) SendPrivate(peerName, text string, id uint32) error {
+	var peer *Peer
+	var roomName string
+	c.lock.Lock()
+	for name, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].Name() == peerName {
+				found := peers[i]
+				peer, roomName = &found, name
 			}
 		}
 	}
+	c.lock.Unlock()
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	return c.sendChat(peer, &ChatMessage{RoomMessage{}, text, c.RoomNick(roomName), id}, PRIVATE_MESSAGE)
+}
+
+// DirectRoom is the name private messages with a peer are filed under.
+func DirectRoom(peerName string) string {
+	return "@" + peerName
+}
+
+// sendChat seals a chat message for one peer. Room messages use the key we
+// share with them, private messages a key derived from it.
+func (c *Client) sendChat(client *Peer, chatMessage *ChatMessage, msgType MessageType) error {
+	if client.state == PeerFailed {
+		log.Warningf("Not sending to unreachable peer %v", client.UDPAddr)
+		return nil
+	}
+	if client.sharedKey == [32]byte{} {
+		return MissingKeyError
+	}
+	roomData, err := chatMessage.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	key, roomName := client.sharedKey, chatMessage.Room
+	if msgType == PRIVATE_MESSAGE {
+		key, roomName = PrivateKey(client.sharedKey), DirectRoom(client.Name())
+	}
+	roomData, err = Seal(key, roomData)
+	if err != nil {
+		return err
+	}
+	sendMe := Message{RawMessage{nil, roomData}, msgType, true, uint16(len(roomData))}
+	data, err := sendMe.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	if c.reliability() != nil {
+		return c.sendReliable(client, data, roomName, chatMessage.ID)
+	}
+	_, err = c.sendToPeer(client, data)
+	if err != nil {
+		return err
+	}
+	log.Infof("Sent to %v", client)
+	return nil
 }
 
-func (c *Client) UpdateRoomList(message Message) {
+func (c *Client) UpdateRoomList(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
 	var rm RoomListMessage
-	rm.DecodeMessage(message.Data)
-	c.rooms[rm.Room] = make([]Peer, rm.Length)
-	log.Infof("Updating room %s", rm.Room)
+	err := rm.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	peers := make([]Peer, 0, len(rm.Addresses))
+	remembered := make(map[string][32]byte)
 	for i := 0; i < len(rm.Addresses); i++ {
-		c.rooms[rm.Room][i] = Peer{rm.Addresses[i], ""}
+		if !verifyJoin(rm.Identities[i], rm.Signatures[i], rm.Room, rm.Keys[i], rm.Requested[i]) {
+			log.Warningf("Ignoring %v in %s, their join is not signed by their identity", rm.Addresses[i], rm.Room)
+			continue
+		}
+		sharedKey, err := c.keys.SharedKey(rm.Keys[i])
+		if err != nil {
+			log.Errorf("No shared key with %v: %v", rm.Addresses[i], err)
+		}
+		peer := Peer{
+			UDPAddr:   rm.Addresses[i],
+			name:      rm.Names[i],
+			publicKey: rm.Keys[i],
+			sharedKey: sharedKey,
+			identity:  rm.Identities[i],
+			state:     PeerPunching,
+		}
+		peer.trust = TrustUnnamed
+		if name, ok := ownName(rm.Requested[i], rm.Names[i]); ok {
+			trust, known, err := c.known.check(name, peer.identity)
+			if err != nil {
+				c.reportError(err)
+			}
+			peer.trust = trust
+			remembered[name] = known
+		}
+		peers = append(peers, peer)
 	}
-	log.Info("Room ", c.rooms[rm.Room])
 
+	c.lock.Lock()
+	if _, ok := c.rooms[rm.Room]; !ok {
+		c.lock.Unlock()
+		log.Warningf("Ignoring room list for %s, we are not in it", rm.Room)
+		return nil
+	}
+	previous := make(map[string]Peer)
+	for _, peer := range c.rooms[rm.Room] {
+		previous[peer.UDPAddr.String()] = peer
+	}
+	// Warn about a changed key once, when it turns up, not on every list.
+	changed := make([]Peer, 0)
+	for i := range peers {
+		old, seen := previous[peers[i].UDPAddr.String()]
+		peers[i].state = old.state
+		peers[i].rtt = old.rtt
+		peers[i].lastSeen = old.lastSeen
+		if peers[i].trust == TrustChanged && (!seen || old.identity != peers[i].identity) {
+			changed = append(changed, peers[i])
+		}
+	}
+	c.rooms[rm.Room] = peers
+	// Logged under the lock, as punching updates these peers in place.
+	log.Infof("Updated room %s: %v", rm.Room, peers)
+	oldNick, named := c.roomNicks[rm.Room]
+	if !named {
+		oldNick = c.nick
+	}
+	c.roomNicks[rm.Room] = rm.Nick
+	// The first list for a room is the server letting us in, past any
+	// password or allow-list, so only now will it share the history.
+	_, admitted := c.tokens[rm.Room]
+	c.tokens[rm.Room] = rm.Token
+	c.lock.Unlock()
+
+	if !admitted {
+		err = c.RequestHistory(rm.Room)
+		if err != nil {
+			c.reportError(err)
+		}
+	}
+
+	for _, peer := range changed {
+		c.warnIdentityChanged(rm.Room, peer, remembered[peer.Name()])
+	}
+	c.membersChanged(rm.Room)
+	c.forgetReliable()
+	if rm.Nick != "" && rm.Nick != oldNick {
+		c.notify(rm.Room, fmt.Sprintf("You are known as %s in %s", rm.Nick, rm.Room))
+	}
+	return nil
 }
 
-func (c *Client) MakeRoomMessage(roomName, message string) Message {
-	var sending Message
-	sending.EncryptedMsg = false
-	sending.MsgType = ROOM_MESSAGE
-	sendMe := &ChatMessage{RoomMessage{roomName}, message}
-	writeToMe := bytes.NewBuffer(make([]byte, 0))
-	err := binary.Write(writeToMe, binary.LittleEndian, sendMe)
-	if err != nil {
-		panic(err)
+// Peers returns a copy of who we know about in a room.
+func (c *Client) Peers(roomName string) []Peer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Peer(nil), c.rooms[roomName]...)
+}
+
+// Members carries the name of each room whose members have changed: someone
+// joined, left or timed out, or how we reach them changed. Read Peers for
+// the new list.
+func (c *Client) Members() chan string {
+	return c.membersChannel
+}
+
+// membersChanged never blocks: if nobody is reading Members the change is
+// dropped, and Peers has the latest list anyway.
+func (c *Client) membersChanged(roomName string) {
+	select {
+	case c.membersChannel <- roomName:
+	default:
+	}
+}
+
+func (p *Peer) Address() *net.UDPAddr {
+	return &p.UDPAddr
+}
+
+// Name is the peer's nickname, falling back to their address.
+func (p *Peer) Name() string {
+	if p.name == "" {
+		return p.UDPAddr.String()
+	}
+	return p.name
+}
+
+func (c *Client) Nick() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nick
+}
+
+// SetNick changes our nickname in every room we are in. The server may
+// hand back a different one if the name is taken.
+func (c *Client) SetNick(nick string) error {
+	if !validNick(nick) {
+		return InvalidNickError
+	}
+	c.lock.Lock()
+	c.nick = nick
+	c.lock.Unlock()
+	for _, roomName := range c.Rooms() {
+		err := c.announce(roomName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validNick reports whether a nickname can be used as one word in commands
+// and the known peers file.
+func validNick(nick string) bool {
+	return nick != "" && utf8.RuneCountInString(nick) <= MAX_NICK_LENGTH && oneWord(nick)
+}
+
+// validRoomName reports whether a room name can be used as one word in
+// commands. Names starting with @ are the tabs for direct messages.
+func validRoomName(roomName string) bool {
+	if roomName == "" || utf8.RuneCountInString(roomName) > MAX_ROOM_NAME_LENGTH {
+		return false
+	}
+	return !strings.HasPrefix(roomName, "@") && oneWord(roomName)
+}
+
+func oneWord(word string) bool {
+	for _, r := range word {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoomNick is the name the server gave us in a room.
+func (c *Client) RoomNick(roomName string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if nick, ok := c.roomNicks[roomName]; ok {
+		return nick
+	}
+	return c.nick
+}
+
+// FormatChat renders a chat line, turning "/me waves" into an action.
+func FormatChat(sender, text string) string {
+	if strings.HasPrefix(text, "/me ") {
+		return fmt.Sprintf("* %s %s", sender, strings.TrimPrefix(text, "/me "))
+	}
+	return fmt.Sprintf("%s says \"%s\"", sender, text)
+}
+
+// findPeer returns a copy of the peer at an address, or nil if they are not
+// in any of our rooms. Use setPeerState to change them.
+func (c *Client) findPeer(addr *net.UDPAddr) *Peer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].UDPAddr.String() == addr.String() {
+				peer := peers[i]
+				return &peer
+			}
+		}
+	}
+	return nil
+}
+
+// setPeerState records how we reach a peer, in every room we share with
+// them. It returns the state they were in before.
+func (c *Client) setPeerState(addr *net.UDPAddr, state PeerState) PeerState {
+	c.lock.Lock()
+	previous := PeerPunching
+	changed := make([]string, 0)
+	for roomName, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].UDPAddr.String() == addr.String() {
+				previous = peers[i].state
+				if previous != state {
+					changed = append(changed, roomName)
+				}
+				peers[i].state = state
+			}
+		}
+	}
+	c.lock.Unlock()
+	for _, roomName := range changed {
+		c.membersChanged(roomName)
 	}
-	return sending
+	return previous
 }
@@ -0,0 +1,145 @@
+package punchy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+var DecryptionError = errors.New("Message cannot be decrypted")
+var MissingKeyError = errors.New("No shared key for peer")
+var KeyFileError = errors.New("Key file does not hold a base64 private key")
+
+// KeyPair is an X25519 key pair. The public half is handed to the server when
+// joining a room and passed on to the other members in the room list.
+type KeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+func NewKeyPair() (*KeyPair, error) {
+	var keys KeyPair
+	_, err := rand.Read(keys.Private[:])
+	if err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(keys.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(keys.Public[:], public)
+	return &keys, nil
+}
+
+// LoadKeyPair reads the private key kept at path, or makes a new pair and
+// saves it there if there is none yet, so we keep the same public key from
+// one run to the next.
+func LoadKeyPair(path string) (*KeyPair, error) {
+	private, err := loadSecret(path, 32)
+	if err != nil {
+		return nil, err
+	}
+	var keys KeyPair
+	copy(keys.Private[:], private)
+	public, err := curve25519.X25519(keys.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(keys.Public[:], public)
+	return &keys, nil
+}
+
+// loadSecret reads size base64 encoded bytes from path, or makes random
+// ones and saves them there, readable only by us, if the file is missing.
+func loadSecret(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		secret := make([]byte, size)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(secret) + "\n"
+		return secret, os.WriteFile(path, []byte(encoded), 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) != size {
+		return nil, KeyFileError
+	}
+	return secret, nil
+}
+
+// SharedKey derives the symmetric key used between us and a peer. Both sides
+// hash the public keys in the same order so they end up with the same key.
+func (k *KeyPair) SharedKey(peerPublic [32]byte) ([32]byte, error) {
+	var key [32]byte
+	secret, err := curve25519.X25519(k.Private[:], peerPublic[:])
+	if err != nil {
+		return key, err
+	}
+	first, second := k.Public[:], peerPublic[:]
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(first)
+	h.Write(second)
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// PrivateKey derives the key for private messages from a peer's shared key,
+// so they are never sealed under the same key as room traffic.
+func PrivateKey(sharedKey [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("lemony private message"))
+	h.Write(sharedKey[:])
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// Seal encrypts plaintext with XChaCha20-Poly1305, prefixing the random nonce.
+func Seal(key [32]byte, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func Open(key [32]byte, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, DecryptionError
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, DecryptionError
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,65 @@
+package punchy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+var UnknownMessageError = errors.New("Unknown message type")
+var UnexpectedSenderError = errors.New("Message from someone who should not be sending it")
+var NotInRoomError = errors.New("Not in that room")
+
+// PacketError is a datagram that was dropped because it could not be
+// decoded or made no sense. It never stops the read loop; it is counted,
+// logged and passed on to whoever is watching Errors.
+type PacketError struct {
+	Sender *net.UDPAddr
+	Type   MessageType
+	Err    error
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("Dropped message type %d from %v: %v", e.Type, e.Sender, e.Err)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// reportError hands an error to the Errors channel. If nobody is keeping up
+// it is only logged, since a slow UI must not stall the network.
+func (c *Client) reportError(err error) {
+	log.Warning(err)
+	select {
+	case c.errorChannel <- err:
+	default:
+	}
+}
+
+// Errors carries anything that went wrong in the background: bad packets,
+// failed sends, socket errors. None of them are fatal.
+func (c *Client) Errors() chan error {
+	return c.errorChannel
+}
+
+func (c *Client) dropPacket(message InboundMessage, err error) {
+	atomic.AddUint64(&c.dropped, 1)
+	c.reportError(&PacketError{message.Sender(), message.Type(), err})
+}
+
+// Dropped is how many datagrams have been thrown away as bad.
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (s *Server) dropPacket(message InboundMessage, err error) {
+	atomic.AddUint64(&s.dropped, 1)
+	log.Warning(&PacketError{message.Sender(), message.Type(), err})
+}
+
+// Dropped is how many datagrams have been thrown away as bad.
+func (s *Server) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
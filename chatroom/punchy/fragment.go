@@ -0,0 +1,289 @@
+package punchy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SAFE_DATAGRAM is the largest datagram we send in one piece. Anything
+// bigger is split into FRAGMENT messages rather than left to IP
+// fragmentation, which is often dropped along the way.
+const SAFE_DATAGRAM = 1200
+
+// fragmentOverhead is the header plus the ID, index, count and data length
+// of a FragmentMessage.
+const fragmentOverhead = HEADER_SIZE + 4 + 2 + 2 + 2
+const fragmentSize = SAFE_DATAGRAM - fragmentOverhead
+
+// MAX_FRAGMENTED_MESSAGE is the largest encoded message that can be sent in
+// fragments. Only messages sent that way may be bigger than one datagram.
+const MAX_FRAGMENTED_MESSAGE = 256 * 1024
+const maxFragments = (MAX_FRAGMENTED_MESSAGE + fragmentSize - 1) / fragmentSize
+
+// socketBuffer is the receive buffer we ask the kernel for, room for a few
+// fragmented messages arriving at once. The kernel may give us less.
+const socketBuffer = 4 * MAX_FRAGMENTED_MESSAGE
+
+const fragmentTimeout = 5 * time.Second
+
+// fragmentMemory caps the bytes held for half-reassembled messages from
+// everyone at once, and fragmentSenderMemory those from any one sender, so
+// one sender cannot use it all.
+const fragmentMemory = 1024 * 1024
+const fragmentSenderMemory = 2 * MAX_FRAGMENTED_MESSAGE
+
+var FragmentError = errors.New("Bad fragment")
+var FragmentMemoryError = errors.New("Too many fragments waiting to be reassembled")
+
+// FragmentMessage is one piece of an encoded datagram. Count pieces with
+// the same ID from the same sender make up the whole.
+type FragmentMessage struct {
+	ID    uint32
+	Index uint16
+	Count uint16
+	Data  []byte
+}
+
+func (m *FragmentMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.ID)
+	w.putUint16(m.Index)
+	w.putUint16(m.Count)
+	w.putBytes(m.Data)
+	return w.bytes()
+}
+
+func (m *FragmentMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.ID = r.getUint32()
+	m.Index = r.getUint16()
+	m.Count = r.getUint16()
+	m.Data = r.getBytes()
+	return r.done()
+}
+
+// fragment splits an encoded datagram into FRAGMENT datagrams no larger
+// than SAFE_DATAGRAM. A datagram that already fits is returned as it is.
+func fragment(datagram []byte, id uint32) ([][]byte, error) {
+	if len(datagram) <= SAFE_DATAGRAM {
+		return [][]byte{datagram}, nil
+	}
+	count := (len(datagram) + fragmentSize - 1) / fragmentSize
+	pieces := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentSize
+		if end > len(datagram) {
+			end = len(datagram)
+		}
+		piece := FragmentMessage{id, uint16(i), uint16(count), datagram[i*fragmentSize : end]}
+		payload, err := piece.EncodeMessage()
+		if err != nil {
+			return nil, err
+		}
+		message := &Message{RawMessage{nil, payload}, FRAGMENT, false, uint16(len(payload))}
+		data, err := message.EncodeMessage()
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, data)
+	}
+	return pieces, nil
+}
+
+type partialMessage struct {
+	sender   string
+	pieces   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// reassembler collects fragments until every piece of a datagram has
+// arrived. Datagrams that are not finished within fragmentTimeout are
+// dropped, and no more is held while fragmentMemory is in use, or
+// fragmentSenderMemory by the sender. Its lock guards everything but nextID.
+type reassembler struct {
+	sync.Mutex
+	nextID  uint32
+	partial map[string]*partialMessage
+	size    int
+	senders map[string]int
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{partial: make(map[string]*partialMessage), senders: make(map[string]int)}
+}
+
+func (r *reassembler) id() uint32 {
+	return atomic.AddUint32(&r.nextID, 1)
+}
+
+// sweep drops datagrams that have stopped arriving part way through, so a
+// sender that goes quiet is not held in memory for ever.
+func (r *reassembler) sweep() {
+	r.Lock()
+	defer r.Unlock()
+	r.expire(time.Now())
+}
+
+func (r *reassembler) expire(now time.Time) {
+	for key, partial := range r.partial {
+		if now.Sub(partial.started) > fragmentTimeout {
+			log.Warningf("Gave up reassembling %s, %d of %d pieces arrived", key, partial.received, len(partial.pieces))
+			r.forget(key, partial)
+		}
+	}
+}
+
+// forget drops a datagram from the memory counts. The lock must be held.
+func (r *reassembler) forget(key string, partial *partialMessage) {
+	delete(r.partial, key)
+	r.size -= partial.size
+	r.senders[partial.sender] -= partial.size
+	if r.senders[partial.sender] <= 0 {
+		delete(r.senders, partial.sender)
+	}
+}
+
+// add files a FRAGMENT message. Once the last piece arrives it returns the
+// whole datagram, decoded as if it had arrived in one piece.
+func (r *reassembler) add(message Message) (*Message, error) {
+	var piece FragmentMessage
+	err := piece.DecodeMessage(message.Data)
+	if err != nil {
+		return nil, err
+	}
+	if piece.Count < 2 || int(piece.Count) > maxFragments || piece.Index >= piece.Count || len(piece.Data) > fragmentSize {
+		return nil, FragmentError
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.expire(now)
+	sender := message.Sender().String()
+	key := fmt.Sprintf("%s/%d", sender, piece.ID)
+	partial := r.partial[key]
+	if partial == nil {
+		partial = &partialMessage{sender: sender, pieces: make([][]byte, piece.Count), started: now}
+		r.partial[key] = partial
+	}
+	if len(partial.pieces) != int(piece.Count) {
+		return nil, FragmentError
+	}
+	if partial.pieces[piece.Index] != nil {
+		return nil, nil
+	}
+	if r.size+len(piece.Data) > fragmentMemory || r.senders[sender]+len(piece.Data) > fragmentSenderMemory {
+		if partial.received == 0 {
+			delete(r.partial, key)
+		}
+		return nil, FragmentMemoryError
+	}
+	partial.pieces[piece.Index] = piece.Data
+	partial.received++
+	partial.size += len(piece.Data)
+	r.size += len(piece.Data)
+	r.senders[sender] += len(piece.Data)
+	if partial.received < len(partial.pieces) {
+		return nil, nil
+	}
+
+	r.forget(key, partial)
+	datagram := make([]byte, 0, partial.size)
+	for _, data := range partial.pieces {
+		datagram = append(datagram, data...)
+	}
+	var whole Message
+	err = whole.decodeReassembled(message.Sender(), datagram)
+	if err != nil {
+		return nil, err
+	}
+	if whole.Type() == FRAGMENT {
+		return nil, FragmentError
+	}
+	return &whole, nil
+}
+
+// growReadBuffer asks for a receive buffer big enough that the fragments of
+// a large message are not dropped before we can read them.
+func growReadBuffer(conn *net.UDPConn) {
+	err := conn.SetReadBuffer(socketBuffer)
+	if err != nil {
+		log.Warningf("Could not grow the receive buffer: %v", err)
+	}
+}
+
+// send writes a datagram to a client, in pieces if it is too big for one.
+func (s *Server) send(data []byte, addr *net.UDPAddr) error {
+	pieces, err := fragment(data, s.fragments.id())
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		_, err = s.Conn.WriteToUDP(piece, addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepFragments runs on the timer wheel every fragmentTimeout.
+func (s *Server) sweepFragments() {
+	s.fragments.sweep()
+	s.wheel.schedule(fragmentTimeout, s.sweepFragments)
+}
+
+// FragmentReceived only takes fragments from members of a room, since
+// nobody else has anything to send that needs them.
+func (s *Server) FragmentReceived(message Message) error {
+	if !s.inAnyRoom(message.Sender()) {
+		return UnexpectedSenderError
+	}
+	whole, err := s.fragments.add(message)
+	if err != nil || whole == nil {
+		return err
+	}
+	return s.handleMessage(*whole)
+}
+
+// send writes a datagram, in pieces if it is too big for one.
+func (c *Client) send(data []byte, addr *net.UDPAddr) (int, error) {
+	pieces, err := fragment(data, c.fragments.id())
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, piece := range pieces {
+		n, err := c.conn.WriteToUDP(piece, addr)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// sweepFragments runs every fragmentTimeout until the client is closed.
+func (c *Client) sweepFragments() {
+	for c.life.sleep(fragmentTimeout) {
+		c.fragments.sweep()
+	}
+}
+
+// FragmentReceived only takes fragments from the server and peers in our
+// rooms, so strangers cannot fill the reassembler.
+func (c *Client) FragmentReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() && c.findPeer(message.Sender()) == nil {
+		return UnexpectedSenderError
+	}
+	whole, err := c.fragments.add(message)
+	if err != nil || whole == nil {
+		return err
+	}
+	return c.handleMessage(*whole)
+}
@@ -0,0 +1,136 @@
+package punchy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// fragmentFrom is a FRAGMENT message as the reassembler sees it.
+func fragmentFrom(port int, piece FragmentMessage) Message {
+	data, err := piece.EncodeMessage()
+	if err != nil {
+		panic(err)
+	}
+	return Message{RawMessage{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, data}, FRAGMENT, false, uint16(len(data))}
+}
+
+// TestReassemble feeds the pieces of one datagram to a reassembler in
+// various orders, and checks it comes back whole exactly once, after the
+// last new piece.
+func TestReassemble(t *testing.T) {
+	chat := &Message{RawMessage{nil, bytes.Repeat([]byte("abcdefgh"), 500)}, ROOM_MESSAGE, true, 0}
+	datagram, err := chat.EncodeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := fragment(datagram, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pieces) != 4 {
+		t.Fatalf("%d byte datagram in %d pieces, want 4", len(datagram), len(pieces))
+	}
+	cases := []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2, 3}},
+		{"reversed", []int{3, 2, 1, 0}},
+		{"shuffled", []int{2, 0, 3, 1}},
+		{"duplicates", []int{0, 0, 1, 2, 1, 3}},
+		{"duplicate after", []int{0, 1, 2, 3, 3}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReassembler()
+			seen := make(map[int]bool)
+			wholes := 0
+			for _, i := range tc.order {
+				var message Message
+				err := message.DecodeMessage(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, pieces[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				whole, err := r.add(message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen[i] = true
+				if whole == nil {
+					continue
+				}
+				wholes++
+				if len(seen) != len(pieces) {
+					t.Fatalf("whole after %d of %d pieces", len(seen), len(pieces))
+				}
+				if whole.Type() != ROOM_MESSAGE || !whole.Encrypted() || !bytes.Equal(whole.Data, chat.Data) {
+					t.Fatal("reassembled something else")
+				}
+			}
+			// A duplicate after the last piece starts a new datagram
+			// that never finishes.
+			if wholes != 1 {
+				t.Fatalf("came back whole %d times", wholes)
+			}
+		})
+	}
+
+	small, err := fragment(pieces[0][:SAFE_DATAGRAM], 2)
+	if err != nil || len(small) != 1 || !bytes.Equal(small[0], pieces[0][:SAFE_DATAGRAM]) {
+		t.Fatal("a datagram that fits was fragmented", err, len(small))
+	}
+}
+
+// TestBadFragments checks pieces that could not belong to a datagram, or
+// disagree with the pieces before them, are rejected.
+func TestBadFragments(t *testing.T) {
+	cases := []struct {
+		name   string
+		before []FragmentMessage
+		piece  FragmentMessage
+		err    error
+	}{
+		{"one piece", nil, FragmentMessage{1, 0, 1, []byte{1}}, FragmentError},
+		{"index past count", nil, FragmentMessage{1, 2, 2, []byte{1}}, FragmentError},
+		{"too many pieces", nil, FragmentMessage{1, 0, maxFragments + 1, []byte{1}}, FragmentError},
+		{"piece too big", nil, FragmentMessage{1, 0, 2, make([]byte, fragmentSize+1)}, FragmentError},
+		{"count changed", []FragmentMessage{{1, 0, 3, []byte{1}}}, FragmentMessage{1, 1, 2, []byte{1}}, FragmentError},
+		{"not a datagram", []FragmentMessage{{1, 0, 2, []byte{1}}}, FragmentMessage{1, 1, 2, []byte{2}}, ProtocolReadError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReassembler()
+			for _, piece := range tc.before {
+				_, err := r.add(fragmentFrom(1, piece))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			whole, err := r.add(fragmentFrom(1, tc.piece))
+			if whole != nil || err != tc.err {
+				t.Fatalf("got %v, %v, want %v", whole, err, tc.err)
+			}
+		})
+	}
+}
+
+// TestFragmentMemory checks one sender cannot hold more than its share,
+// and that leaves room for everyone else.
+func TestFragmentMemory(t *testing.T) {
+	r := newReassembler()
+	var err error
+	for id := uint32(1); err == nil; id++ {
+		_, err = r.add(fragmentFrom(1, FragmentMessage{id, 0, maxFragments, make([]byte, fragmentSize)}))
+	}
+	if err != FragmentMemoryError {
+		t.Fatal(err)
+	}
+	if r.senders["127.0.0.1:1"] > fragmentSenderMemory {
+		t.Fatalf("holding %d bytes for one sender", r.senders["127.0.0.1:1"])
+	}
+	_, err = r.add(fragmentFrom(2, FragmentMessage{1, 0, maxFragments, make([]byte, fragmentSize)}))
+	if err != nil {
+		t.Fatal("second sender:", err)
+	}
+}
@@ -1,8 +1,6 @@
 package punchy
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"net"
 )
@@ -19,6 +17,28 @@ const (
 	ROOM_LIST             MessageType = 7
 	ROOM_MESSAGE          MessageType = 8
 	ROOM_HISTORY          MessageType = 9
+	PUNCH_SCHEDULE        MessageType = 10
+	PUNCH                 MessageType = 11
+	PUNCH_ACK             MessageType = 12
+	RELAY_MESSAGE         MessageType = 13
+	VERSION_MISMATCH      MessageType = 14
+	RELIABLE_MESSAGE      MessageType = 15
+	ACK                   MessageType = 16
+	FRAGMENT              MessageType = 17
+	FILE_OFFER            MessageType = 18
+	FILE_ACCEPT           MessageType = 19
+	FILE_REJECT           MessageType = 20
+	FILE_CHUNK            MessageType = 21
+	PRIVATE_MESSAGE       MessageType = 22
+	ROOM_CHALLENGE        MessageType = 23
+	ROOM_RESPONSE         MessageType = 24
+	ROOM_REJECTED         MessageType = 25
+	PRESENCE              MessageType = 26
+	HEARTBEAT             MessageType = 27
+	HEARTBEAT_ACK         MessageType = 28
+	TYPING                MessageType = 29
+	READ_RECEIPT          MessageType = 30
+	HISTORY               MessageType = 31
 )
 const MAX_UDP_DATAGRAM = 65507
 
@@ -38,139 +58,187 @@ type RoomMessage struct {
 	Room string
 }
 
+// ConnectRoomMessage carries the joining client's public key, which the
+// server hands to the rest of the room so each pair can agree a shared key.
+// Signature is the client's Ed25519 Identity signing the room, that key and
+// the Name asked for.
 type ConnectRoomMessage struct {
 	RoomMessage
 	sharedKey [32]byte
+	Name      string
+	Identity  [32]byte
+	Signature [64]byte
 }
 
+// ChatMessage is one line of chat. ID is picked by the sender so that
+// delivery reports can refer back to it.
 type ChatMessage struct {
 	RoomMessage
 	Message string
+	Name    string
+	ID      uint32
+}
+
+// RelayMessage wraps an encoded Message for the server to forward. Going up
+// to the server Peer is who it is for, coming back down it is who sent it.
+type RelayMessage struct {
+	Peer    net.UDPAddr
+	Payload []byte
 }
 
 var ProtocolReadError = errors.New("Message cannot be read")
 var ProtocolWriteError = errors.New("Message cannot be written")
 
 func (m *RoomMessage) EncodeMessage() ([]byte, error) {
-	w := new(bytes.Buffer)
-	enc := gob.NewEncoder(w)
-	err := enc.Encode(m.Room)
-	if err != nil {
-		panic(err)
-	}
-	return w.Bytes(), nil
+	w := new(wireWriter)
+	w.putString(m.Room)
+	return w.bytes()
 }
 
 func (m *RoomMessage) DecodeMessage(buf []byte) error {
-	r := bytes.NewBuffer(buf)
-	decoder := gob.NewDecoder(r)
-	err := decoder.Decode(&m.Room)
-	if err != nil {
-		panic(err)
-	}
-	return nil
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	return r.done()
 }
 
 func (m *ConnectRoomMessage) EncodeMessage() ([]byte, error) {
-	w := new(bytes.Buffer)
-	enc := gob.NewEncoder(w)
-	err := enc.Encode(m.Room)
-	if err != nil {
-		panic(err)
-	}
-	err = enc.Encode(m.sharedKey)
-	if err != nil {
-		panic(err)
-	}
-	return w.Bytes(), nil
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putKey(m.sharedKey)
+	w.putString(m.Name)
+	w.putKey(m.Identity)
+	w.putSignature(m.Signature)
+	return w.bytes()
+}
+
+func (m *ConnectRoomMessage) RawMessage() (RawMessage, error) {
+	var raw RawMessage
+	data, err := m.EncodeMessage()
+	raw.Data = data
+	return raw, err
 }
 
 func (m *ConnectRoomMessage) DecodeMessage(buf []byte) error {
-	r := bytes.NewBuffer(buf)
-	decoder := gob.NewDecoder(r)
-	err := decoder.Decode(&m.Room)
-	if err != nil {
-		panic(err)
-	}
-	err = decoder.Decode(&m.sharedKey)
-	if err != nil {
-		panic(err)
-	}
-	return nil
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.sharedKey = r.getKey()
+	m.Name = r.getString()
+	m.Identity = r.getKey()
+	m.Signature = r.getSignature()
+	return r.done()
 }
 
 func (m *ChatMessage) EncodeMessage() ([]byte, error) {
-	w := new(bytes.Buffer)
-	enc := gob.NewEncoder(w)
-	err := enc.Encode(m.Room)
-	if err != nil {
-		panic(err)
-	}
-	err = enc.Encode(m.Message)
-	if err != nil {
-		panic(err)
-	}
-	return w.Bytes(), nil
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putString(m.Message)
+	w.putString(m.Name)
+	w.putUint32(m.ID)
+	return w.bytes()
 }
 
 func (m *ChatMessage) DecodeMessage(buf []byte) error {
-	r := bytes.NewBuffer(buf)
-	decoder := gob.NewDecoder(r)
-	err := decoder.Decode(&m.Room)
-	if err != nil {
-		panic(err)
-	}
-	err = decoder.Decode(&m.Message)
-	if err != nil {
-		panic(err)
-	}
-	return nil
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Message = r.getString()
+	m.Name = r.getString()
+	m.ID = r.getUint32()
+	return r.done()
+}
+
+func (m *RelayMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putAddress(&m.Peer)
+	w.putBytes(m.Payload)
+	return w.bytes()
+}
+
+func (m *RelayMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Peer = r.getAddress()
+	m.Payload = r.getBytes()
+	return r.done()
 }
 
+// DecodeMessage reads the header described in wire.go. A datagram from
+// another protocol version gives a *VersionError, unless it is the
+// VERSION_MISMATCH that says so.
 func (m *Message) DecodeMessage(sender *net.UDPAddr, p []byte) error {
-	buffy := bytes.NewBuffer(p)
-	decod := gob.NewDecoder(buffy)
-	err := decod.Decode(&m.MsgType)
-	if err != nil {
-		return ProtocolReadError
-	}
-	err = decod.Decode(&m.EncryptedMsg)
-	if err != nil {
-		return ProtocolReadError
-	}
-	err = decod.Decode(&m.Length)
-	if err != nil {
-		return ProtocolReadError
-	}
-	err = decod.Decode(&m.Data)
-	if err != nil {
+	return m.decode(sender, p, false)
+}
+
+// decodeReassembled reads a datagram put back together from fragments,
+// which may be too big for its length field.
+func (m *Message) decodeReassembled(sender *net.UDPAddr, p []byte) error {
+	return m.decode(sender, p, true)
+}
+
+func (m *Message) decode(sender *net.UDPAddr, p []byte, reassembled bool) error {
+	m.RawMessage.Sender = sender
+	if len(p) < HEADER_SIZE || p[0] != protocolMagic[0] || p[1] != protocolMagic[1] {
 		return ProtocolReadError
 	}
-	if err != nil {
+	r := &wireReader{buf: p[2:]}
+	version := r.getUint8()
+	m.MsgType = MessageType(r.getUint8())
+	if version != PROTOCOL_VERSION && m.MsgType != VERSION_MISMATCH {
+		return &VersionError{version}
+	}
+	flags := r.getUint8()
+	m.EncryptedMsg = flags&flagEncrypted != 0
+	m.Length = r.getUint16()
+	oversized := reassembled && m.Length == 0 && len(r.buf) > 0xffff
+	if int(m.Length) != len(r.buf) && !oversized {
 		return ProtocolReadError
 	}
-	m.RawMessage.Sender = sender
-	return nil
+	// The read buffer is reused for the next datagram, so keep a copy.
+	m.Data = append([]byte(nil), r.take(len(r.buf))...)
+	return r.done()
 }
 
 func (m *Message) EncodeMessage() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(m.MsgType)
-	if err != nil {
-		return nil, ProtocolWriteError
+	if HEADER_SIZE+len(m.Data) > MAX_UDP_DATAGRAM {
+		return nil, MessageTooLargeError
 	}
-	err = enc.Encode(m.EncryptedMsg)
-	if err != nil {
-		return nil, ProtocolWriteError
-	}
-	err = enc.Encode(m.Length)
-	if err != nil {
-		return nil, ProtocolWriteError
-	}
-	err = enc.Encode(m.Data)
-	if err != nil {
-		return nil, ProtocolWriteError
+	return m.encode()
+}
+
+// encodeFragmented encodes a message that will only be sent in fragments,
+// so may be bigger than one datagram, up to MAX_FRAGMENTED_MESSAGE.
+func (m *Message) encodeFragmented() ([]byte, error) {
+	if HEADER_SIZE+len(m.Data) > MAX_FRAGMENTED_MESSAGE {
+		return nil, MessageTooLargeError
 	}
-	return buf.Bytes(), nil
+	return m.encode()
+}
+
+func (m *Message) encode() ([]byte, error) {
+	m.Length = uint16(len(m.Data))
+	if len(m.Data) > 0xffff {
+		m.Length = 0
+	}
+	w := &wireWriter{buf: make([]byte, 0, HEADER_SIZE+len(m.Data))}
+	w.putUint8(protocolMagic[0])
+	w.putUint8(protocolMagic[1])
+	w.putUint8(PROTOCOL_VERSION)
+	w.putUint8(uint8(m.MsgType))
+	var flags uint8
+	if m.EncryptedMsg {
+		flags |= flagEncrypted
+	}
+	w.putUint8(flags)
+	w.putUint16(m.Length)
+	w.buf = append(w.buf, m.Data...)
+	return w.bytes()
+}
+
+// versionMismatch is the reply to a datagram from another protocol version,
+// telling the sender which version we speak.
+var versionMismatch = []byte{protocolMagic[0], protocolMagic[1], PROTOCOL_VERSION, uint8(VERSION_MISMATCH), 0, 0, 1, PROTOCOL_VERSION}
+
+// MismatchedVersion reads the version out of a VERSION_MISMATCH.
+func (m *Message) MismatchedVersion() (uint8, error) {
+	r := &wireReader{buf: m.Data}
+	version := r.getUint8()
+	return version, r.done()
 }
@@ -0,0 +1,163 @@
+package punchy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DEFAULT_HEARTBEAT is how often we check in with each connected peer.
+// NAT mappings are commonly dropped after 30 seconds of quiet, so it is
+// kept well inside that.
+const DEFAULT_HEARTBEAT = 10 * time.Second
+
+// quietHeartbeats is how many heartbeats a peer may miss before we assume
+// the path to them has closed and punch it open again.
+const quietHeartbeats = 3
+
+// HeartbeatMessage is sent as a HEARTBEAT to a peer, who echoes it back as
+// a HEARTBEAT_ACK so we can time the round trip. Sent only means anything
+// to whoever sent it.
+type HeartbeatMessage struct {
+	Sent uint64
+}
+
+func (m *HeartbeatMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint64(m.Sent)
+	return w.bytes()
+}
+
+func (m *HeartbeatMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Sent = r.getUint64()
+	return r.done()
+}
+
+// SetHeartbeat changes how often we check in with each connected peer.
+// It takes effect from the next heartbeat. Zero or less stops them,
+// leaving NAT mappings to expire.
+func (c *Client) SetHeartbeat(interval time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heartbeat = interval
+}
+
+func (c *Client) heartbeatInterval() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.heartbeat
+}
+
+// Heartbeat keeps the path to every connected peer open by sending each a
+// heartbeat on the interval, and punches again to any peer that has gone
+// quiet for too long.
+func (c *Client) Heartbeat() {
+	for {
+		interval := c.heartbeatInterval()
+		if interval <= 0 {
+			interval = DEFAULT_HEARTBEAT
+		}
+		if !c.life.sleep(interval) {
+			return
+		}
+		if c.heartbeatInterval() <= 0 {
+			continue
+		}
+		// A peer we share several rooms with is only checked once.
+		checked := make(map[string]bool)
+		quiet := make(map[string][]net.UDPAddr)
+		for _, roomName := range c.Rooms() {
+			for _, peer := range c.Peers(roomName) {
+				if peer.state != PeerConnected || checked[peer.UDPAddr.String()] {
+					continue
+				}
+				checked[peer.UDPAddr.String()] = true
+				if time.Since(peer.lastSeen) > quietHeartbeats*interval {
+					quiet[roomName] = append(quiet[roomName], peer.UDPAddr)
+					continue
+				}
+				err := c.sendHeartbeat(HEARTBEAT, HeartbeatMessage{uint64(time.Since(c.started))}, peer.Address())
+				if err != nil {
+					log.Warningf("Heartbeat to %v: %v", peer.Address(), err)
+				}
+			}
+		}
+		for roomName, addresses := range quiet {
+			for i := range addresses {
+				log.Warningf("%v has gone quiet, punching again", &addresses[i])
+				c.setPeerState(&addresses[i], PeerPunching)
+				c.notify(roomName, fmt.Sprintf("%v has gone quiet, reconnecting", &addresses[i]))
+			}
+			schedule := PunchScheduleMessage{RoomMessage{roomName}, 0, addresses}
+			c.life.spawn(func() { c.Punch(schedule) })
+		}
+	}
+}
+
+func (c *Client) sendHeartbeat(msgType MessageType, heartbeat HeartbeatMessage, addr *net.UDPAddr) error {
+	payload, err := heartbeat.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, msgType, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// HeartbeatReceived answers a peer's heartbeat, or times the round trip
+// when it is the answer to ours.
+func (c *Client) HeartbeatReceived(message Message) error {
+	var heartbeat HeartbeatMessage
+	err := heartbeat.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	sender := message.Sender()
+	if c.findPeer(sender) == nil {
+		return PeerNotFoundError
+	}
+	if message.Type() == HEARTBEAT {
+		c.sawPeer(sender, 0)
+		return c.sendHeartbeat(HEARTBEAT_ACK, heartbeat, sender)
+	}
+	rtt := time.Since(c.started) - time.Duration(heartbeat.Sent)
+	if rtt < 0 || rtt > time.Minute {
+		return ProtocolReadError
+	}
+	c.sawPeer(sender, rtt)
+	return nil
+}
+
+// sawPeer notes that a peer has just been heard from, and how long the
+// round trip to them took if we timed it.
+func (c *Client) sawPeer(addr *net.UDPAddr, rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for _, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].UDPAddr.String() == addr.String() {
+				peers[i].lastSeen = now
+				if rtt > 0 {
+					peers[i].rtt = rtt
+				}
+			}
+		}
+	}
+}
+
+// RTT is the round trip time to the peer at the last heartbeat, or zero if
+// we have not timed one yet.
+func (p *Peer) RTT() time.Duration {
+	return p.rtt
+}
+
+// LastSeen is when we last heard from the peer directly.
+func (p *Peer) LastSeen() time.Time {
+	return p.lastSeen
+}
@@ -0,0 +1,323 @@
+package punchy
+
+import (
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+// HISTORY_SIZE is how many messages the server keeps for each room.
+const HISTORY_SIZE = 100
+
+// HISTORY_REQUEST_SIZE is how many messages a client asks for on joining.
+const HISTORY_REQUEST_SIZE = 50
+
+// HISTORY_RETENTION is how long the server keeps the history of a room
+// after its last member leaves, in case someone comes back to it.
+const HISTORY_RETENTION = 24 * time.Hour
+
+// historyDatagramSize keeps each ROOM_HISTORY reply comfortably inside a
+// single datagram.
+const historyDatagramSize = 1024
+
+// HistoryEntry is one chat message as the server stores it. Data is an
+// encoded ChatMessage, sealed with the room's history key if Encrypted.
+// Sender and Name are filled in by the server, Name being the nickname it
+// gave the sender in the room.
+type HistoryEntry struct {
+	Sender    net.UDPAddr
+	Name      string
+	Encrypted bool
+	Data      []byte
+}
+
+// HistoryMessage carries history entries, either a client's copy of a
+// message it sent, as a HISTORY message, or a slice of a room's backlog
+// coming back from the server as a ROOM_HISTORY.
+type HistoryMessage struct {
+	RoomMessage
+	Entries []HistoryEntry
+}
+
+// keptHistory is the history of a room nobody is in any more.
+type keptHistory struct {
+	entries []HistoryEntry
+	dropped time.Time
+}
+
+type HistoryRequestMessage struct {
+	RoomMessage
+	Count uint16
+}
+
+// HistoryKey turns a passphrase shared out of band into the key history
+// copies are sealed with, so the server only ever stores ciphertext.
+func HistoryKey(passphrase string) [32]byte {
+	return sha256.Sum256([]byte("lemony-history:" + passphrase))
+}
+
+func (m *HistoryMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putLength(len(m.Entries))
+	for i := range m.Entries {
+		w.putAddress(&m.Entries[i].Sender)
+		w.putString(m.Entries[i].Name)
+		w.putBool(m.Entries[i].Encrypted)
+		w.putBytes(m.Entries[i].Data)
+	}
+	return w.bytes()
+}
+
+func (m *HistoryMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Entries = make([]HistoryEntry, r.getCount(1+net.IPv4len+2+2+1+2))
+	for i := range m.Entries {
+		m.Entries[i].Sender = r.getAddress()
+		m.Entries[i].Name = r.getString()
+		m.Entries[i].Encrypted = r.getBool()
+		m.Entries[i].Data = r.getBytes()
+	}
+	return r.done()
+}
+
+func (m *HistoryRequestMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint16(m.Count)
+	return w.bytes()
+}
+
+func (m *HistoryRequestMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Count = r.getUint16()
+	return r.done()
+}
+
+// StoreHistory keeps a copy of a message a member sent to their room.
+func (s *Server) StoreHistory(message Message) error {
+	var history HistoryMessage
+	err := history.DecodeMessage(message.RawData())
+	if err != nil {
+		return err
+	}
+	room := s.room(history.Room)
+	if room == nil {
+		return NotInRoomError
+	}
+	room.Lock()
+	defer room.Unlock()
+	member := room.clients[message.Sender().String()]
+	if member == nil {
+		return NotInRoomError
+	}
+	for _, entry := range history.Entries {
+		entry.Sender = *message.Sender()
+		entry.Name = member.name
+		room.history = append(room.history, entry)
+	}
+	if len(room.history) > HISTORY_SIZE {
+		room.history = room.history[len(room.history)-HISTORY_SIZE:]
+	}
+	return nil
+}
+
+// keepHistory holds on to the history of a room being dropped. s.lock and
+// the room's lock must be held.
+func (s *Server) keepHistory(room *ChatRoom) {
+	if len(room.history) > 0 {
+		s.keptHistory[room.name] = &keptHistory{room.history, time.Now()}
+	}
+}
+
+// restoreHistory gives a room made afresh the history it had when it was
+// last dropped. s.lock must be held.
+func (s *Server) restoreHistory(room *ChatRoom) {
+	if kept := s.keptHistory[room.name]; kept != nil {
+		room.history = kept.entries
+		delete(s.keptHistory, room.name)
+	}
+}
+
+// pruneHistory forgets the history of rooms that have been empty for
+// HISTORY_RETENTION. It runs on the timer wheel every ping interval.
+func (s *Server) pruneHistory() {
+	s.lock.Lock()
+	for roomName, kept := range s.keptHistory {
+		if time.Since(kept.dropped) > HISTORY_RETENTION {
+			log.Infof("Forgetting the history of %s", roomName)
+			delete(s.keptHistory, roomName)
+		}
+	}
+	s.lock.Unlock()
+	s.wheel.schedule(s.Config.PingInterval, s.pruneHistory)
+}
+
+// SendHistory replies to a member with the last messages in their room, as
+// many datagrams as it takes.
+func (s *Server) SendHistory(message Message) error {
+	var request HistoryRequestMessage
+	err := request.DecodeMessage(message.RawData())
+	if err != nil {
+		return err
+	}
+	room := s.room(request.Room)
+	if room == nil {
+		return NotInRoomError
+	}
+	room.Lock()
+	if room.clients[message.Sender().String()] == nil {
+		room.Unlock()
+		return NotInRoomError
+	}
+	entries := append([]HistoryEntry(nil), room.history...)
+	room.Unlock()
+	if int(request.Count) < len(entries) {
+		entries = entries[len(entries)-int(request.Count):]
+	}
+	start, size := 0, 0
+	for i, entry := range entries {
+		size += len(entry.Data) + len(entry.Name) + 64
+		if size > historyDatagramSize && i > start {
+			err = s.sendHistoryChunk(message.Sender(), request.Room, entries[start:i])
+			if err != nil {
+				return err
+			}
+			start, size = i, len(entry.Data)+len(entry.Name)+64
+		}
+	}
+	if start < len(entries) {
+		return s.sendHistoryChunk(message.Sender(), request.Room, entries[start:])
+	}
+	return nil
+}
+
+func (s *Server) sendHistoryChunk(client *net.UDPAddr, roomName string, entries []HistoryEntry) error {
+	history := HistoryMessage{RoomMessage{roomName}, entries}
+	payload, err := history.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, ROOM_HISTORY, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return s.send(data, client)
+}
+
+// EnableHistory opts in to sending the server a copy of everything we say.
+// Copies are plaintext unless a history key has been set.
+func (c *Client) EnableHistory() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shareHistory = true
+}
+
+// SetHistoryKey sets the key used to seal our history copies and to open
+// other members' sealed history.
+func (c *Client) SetHistoryKey(key [32]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.historyKey = &key
+}
+
+func (c *Client) historyOptions() (bool, *[32]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.shareHistory, c.historyKey
+}
+
+func (c *Client) History() chan DisplayMessage {
+	return c.historyChannel
+}
+
+func (c *Client) sendHistoryCopy(roomName string, chatMessage *ChatMessage) error {
+	data, err := chatMessage.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	entry := HistoryEntry{Data: data}
+	if _, key := c.historyOptions(); key != nil {
+		entry.Data, err = Seal(*key, data)
+		if err != nil {
+			return err
+		}
+		entry.Encrypted = true
+	}
+	history := HistoryMessage{RoomMessage{roomName}, []HistoryEntry{entry}}
+	payload, err := history.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, HISTORY, false, uint16(len(payload))}
+	data, err = message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.send(data, c.middleMan)
+	return err
+}
+
+func (c *Client) RequestHistory(roomName string) error {
+	request := HistoryRequestMessage{RoomMessage{roomName}, HISTORY_REQUEST_SIZE}
+	payload, err := request.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, payload}, ROOM_HISTORY, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, c.middleMan)
+	return err
+}
+
+// HistoryReceived turns a slice of room backlog from the server into lines
+// for the history channel. Entries we cannot open are skipped.
+func (c *Client) HistoryReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var history HistoryMessage
+	err := history.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	_, key := c.historyOptions()
+	for _, entry := range history.Entries {
+		data := entry.Data
+		if entry.Encrypted {
+			if key == nil {
+				log.Warningf("Skipping encrypted history from %v, no history key", &entry.Sender)
+				continue
+			}
+			data, err = Open(*key, data)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+		var chatMessage ChatMessage
+		err = chatMessage.DecodeMessage(data)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		// The name inside the message is whatever the sender wrote there,
+		// so show the one the server gave them instead.
+		name := entry.Name
+		if name == "" {
+			name = entry.Sender.String()
+		}
+		select {
+		case c.historyChannel <- DisplayMessage{history.Room, FormatChat(name, chatMessage.Message)}:
+		default:
+			log.Warning("History channel full, dropping history")
+		}
+	}
+	return nil
+}
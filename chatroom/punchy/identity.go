@@ -0,0 +1,298 @@
+package punchy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var SignatureError = errors.New("Join is not signed by the identity it claims")
+var UnnamedPeerError = errors.New("Peer has no name of their own to trust a key for")
+
+// Trust is what we make of a peer's identity key.
+type Trust uint8
+
+const (
+	// TrustNew is a peer we had never seen, whose key is now remembered.
+	TrustNew Trust = iota
+	// TrustKnown is a peer with the key we remember for them.
+	TrustKnown
+	// TrustChanged is a peer whose key is not the one we remember. Either
+	// they have a new key or someone is pretending to be them.
+	TrustChanged
+	// TrustUnnamed is a peer going by the default nickname or one the
+	// server picked for them, which says nothing about who they are, so no
+	// key is remembered for it.
+	TrustUnnamed
+)
+
+func (t Trust) String() string {
+	switch t {
+	case TrustNew:
+		return "new"
+	case TrustKnown:
+		return "known"
+	case TrustChanged:
+		return "CHANGED"
+	case TrustUnnamed:
+		return "unnamed"
+	}
+	return "unknown"
+}
+
+// NewIdentity makes a fresh Ed25519 identity key.
+func NewIdentity() (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// LoadIdentity reads the identity key kept at path, or makes one and saves
+// it there if there is none yet.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	seed, err := loadSecret(path, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// joinStatement is what a client signs to join a room: the room, the X25519
+// key it will use there and the nickname it asked for, so nobody, the
+// server included, can swap in a key or name of their own without the
+// identity changing too.
+func joinStatement(roomName string, key [32]byte, name string) []byte {
+	var statement bytes.Buffer
+	statement.WriteString("lemony join\x00")
+	statement.WriteString(roomName)
+	statement.WriteByte(0)
+	statement.Write(key[:])
+	statement.WriteString(name)
+	return statement.Bytes()
+}
+
+func signJoin(identity ed25519.PrivateKey, join *ConnectRoomMessage) {
+	copy(join.Identity[:], identity.Public().(ed25519.PublicKey))
+	copy(join.Signature[:], ed25519.Sign(identity, joinStatement(join.Room, join.sharedKey, join.Name)))
+}
+
+func verifyJoin(identity [32]byte, signature [64]byte, roomName string, key [32]byte, name string) bool {
+	return ed25519.Verify(identity[:], joinStatement(roomName, key, name), signature[:])
+}
+
+// ownName is the nickname a peer's key can be remembered under: the one
+// they asked for and signed, if the server let them have it. The default
+// nickname is shared by everyone who does not ask for one, so it is no
+// name at all.
+func ownName(requested, given string) (string, bool) {
+	if requested == "" || requested == DEFAULT_NICK || requested != given {
+		return "", false
+	}
+	return requested, true
+}
+
+// Fingerprint is a short form of an identity key for people to read to
+// each other.
+func Fingerprint(identity [32]byte) string {
+	sum := sha256.Sum256(identity[:])
+	encoded := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// KnownPeers remembers the identity key each nickname had the first time we
+// saw it, trusting it from then on. Only nicknames peers asked for and
+// signed themselves are remembered. The file holds a base64 key and a name
+// on each line.
+type KnownPeers struct {
+	sync.Mutex
+	path string
+	keys map[string][32]byte
+}
+
+func newKnownPeers() *KnownPeers {
+	return &KnownPeers{keys: make(map[string][32]byte)}
+}
+
+// LoadKnownPeers reads a known peers file. A missing file is fine, it is
+// made the first time there is someone to remember.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	known := newKnownPeers()
+	known.path = path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		encoded, name, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s: bad key for %s", path, name)
+		}
+		var identity [32]byte
+		copy(identity[:], key)
+		known.keys[name] = identity
+	}
+	return known, scanner.Err()
+}
+
+// check compares a peer's key with the one we remember, remembering it if
+// they are new. The remembered key is returned too, for warning about it.
+func (k *KnownPeers) check(name string, identity [32]byte) (Trust, [32]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+	known, ok := k.keys[name]
+	if ok && known == identity {
+		return TrustKnown, known, nil
+	} else if ok {
+		return TrustChanged, known, nil
+	}
+	if strings.ContainsAny(name, " \r\n") {
+		// Not a name the file can hold, so only remember it for now.
+		k.keys[name] = identity
+		return TrustNew, identity, nil
+	}
+	k.keys[name] = identity
+	return TrustNew, identity, k.save()
+}
+
+// trust replaces the key remembered for a peer, once the user has made sure
+// their new one is genuine.
+func (k *KnownPeers) trust(name string, identity [32]byte) error {
+	k.Lock()
+	defer k.Unlock()
+	k.keys[name] = identity
+	return k.save()
+}
+
+func (k *KnownPeers) save() error {
+	if k.path == "" {
+		return nil
+	}
+	names := make([]string, 0, len(k.keys))
+	for name := range k.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var data bytes.Buffer
+	for _, name := range names {
+		if strings.ContainsAny(name, " \r\n") {
+			continue
+		}
+		key := k.keys[name]
+		fmt.Fprintf(&data, "%s %s\n", base64.StdEncoding.EncodeToString(key[:]), name)
+	}
+	err := os.MkdirAll(filepath.Dir(k.path), 0700)
+	if err != nil {
+		return err
+	}
+	temporary := k.path + ".new"
+	err = os.WriteFile(temporary, data.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, k.path)
+}
+
+// SetIdentity replaces the identity key made by NewClient, for instance
+// with one from LoadIdentity. Call it before joining any rooms.
+func (c *Client) SetIdentity(identity ed25519.PrivateKey) {
+	c.identity = identity
+}
+
+// SetKnownPeers sets where peers' identity keys are remembered. Without it
+// they are only remembered until we exit.
+func (c *Client) SetKnownPeers(known *KnownPeers) {
+	c.known = known
+}
+
+// Fingerprint is our own identity key's fingerprint.
+func (c *Client) Fingerprint() string {
+	var identity [32]byte
+	copy(identity[:], c.identity.Public().(ed25519.PublicKey))
+	return Fingerprint(identity)
+}
+
+// Trust accepts a peer's current identity key as theirs from now on, after
+// it has changed and the user has checked the new fingerprint with them.
+func (c *Client) Trust(peerName string) error {
+	var peer *Peer
+	c.lock.Lock()
+	for _, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].Name() == peerName {
+				found := peers[i]
+				peer = &found
+			}
+		}
+	}
+	c.lock.Unlock()
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	if peer.trust == TrustUnnamed {
+		return UnnamedPeerError
+	}
+	err := c.known.trust(peerName, peer.identity)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	for _, peers := range c.rooms {
+		for i := range peers {
+			if peers[i].Name() == peerName && peers[i].identity == peer.identity {
+				peers[i].trust = TrustKnown
+			}
+		}
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// warnIdentityChanged tells the room, as loudly as we can, that a peer's
+// identity key is not the one we remember for them.
+func (c *Client) warnIdentityChanged(roomName string, peer Peer, known [32]byte) {
+	log.Warningf("Identity key for %s has changed", peer.Name())
+	banner := strings.Repeat("@", 64)
+	c.notify(roomName, strings.Join([]string{
+		banner,
+		fmt.Sprintf("WARNING: %s's IDENTITY KEY HAS CHANGED!", peer.Name()),
+		"It was    " + Fingerprint(known),
+		"It is now " + Fingerprint(peer.identity),
+		"Someone may be pretending to be them. Check the new fingerprint",
+		fmt.Sprintf("with them another way, then /trust %s if it is right.", peer.Name()),
+		banner,
+	}, "\n"))
+}
+
+func (p *Peer) Identity() [32]byte {
+	return p.identity
+}
+
+func (p *Peer) Fingerprint() string {
+	return Fingerprint(p.identity)
+}
+
+func (p *Peer) Trust() Trust {
+	return p.trust
+}
@@ -0,0 +1,325 @@
+package punchy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var StalePongError = errors.New("Pong does not answer our last ping")
+var ServerConfigError = errors.New("Keepalive timings must be positive")
+
+// ServerConfig is how the server decides whether its members are still
+// there.
+type ServerConfig struct {
+	// PingInterval is how often each member of each room is pinged.
+	PingInterval time.Duration
+	// Timeout evicts a member who has not answered a ping for this long.
+	Timeout time.Duration
+	// MaxMissedPings evicts a member who has missed this many pings in a
+	// row, even inside Timeout.
+	MaxMissedPings int
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		PingInterval:   10 * time.Second,
+		Timeout:        60 * time.Second,
+		MaxMissedPings: 5,
+	}
+}
+
+// validate rejects timings that would ping without pause and evict every
+// member at once.
+func (config ServerConfig) validate() error {
+	if config.PingInterval <= 0 {
+		return fmt.Errorf("Ping interval %v: %w", config.PingInterval, ServerConfigError)
+	}
+	if config.Timeout <= 0 {
+		return fmt.Errorf("Timeout %v: %w", config.Timeout, ServerConfigError)
+	}
+	if config.MaxMissedPings <= 0 {
+		return fmt.Errorf("Max missed pings %d: %w", config.MaxMissedPings, ServerConfigError)
+	}
+	return nil
+}
+
+type PresenceEvent uint8
+
+const (
+	PRESENCE_TIMED_OUT PresenceEvent = 1
+)
+
+func (e PresenceEvent) String() string {
+	switch e {
+	case PRESENCE_TIMED_OUT:
+		return "timed out"
+	}
+	return "changed"
+}
+
+// PresenceMessage tells the members of a room about someone else in it,
+// such as that they stopped answering pings and have been evicted.
+type PresenceMessage struct {
+	RoomMessage
+	Event   PresenceEvent
+	Address net.UDPAddr
+	Name    string
+}
+
+// PingMessage asks a member of a room whether they are still there. Nonce
+// is fresh for every ping.
+type PingMessage struct {
+	RoomMessage
+	Nonce [32]byte
+}
+
+// PongMessage answers a ping. Proof is an HMAC-SHA256 of the nonce and room
+// keyed by the session token the member was given in their room list, so
+// nobody else can answer for them, and each answer only counts once.
+type PongMessage struct {
+	RoomMessage
+	Nonce [32]byte
+	Proof [32]byte
+}
+
+func (m *PingMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putKey(m.Nonce)
+	return w.bytes()
+}
+
+func (m *PingMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Nonce = r.getKey()
+	return r.done()
+}
+
+func (m *PongMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putKey(m.Nonce)
+	w.putKey(m.Proof)
+	return w.bytes()
+}
+
+func (m *PongMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Nonce = r.getKey()
+	m.Proof = r.getKey()
+	return r.done()
+}
+
+func (m *PresenceMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint8(uint8(m.Event))
+	w.putAddress(&m.Address)
+	w.putString(m.Name)
+	return w.bytes()
+}
+
+func (m *PresenceMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Event = PresenceEvent(r.getUint8())
+	m.Address = r.getAddress()
+	m.Name = r.getString()
+	return r.done()
+}
+
+func pongProof(token, nonce [32]byte, roomName string) [32]byte {
+	var proof [32]byte
+	mac := hmac.New(sha256.New, token[:])
+	mac.Write([]byte("lemony pong"))
+	mac.Write(nonce[:])
+	mac.Write([]byte(roomName))
+	copy(proof[:], mac.Sum(nil))
+	return proof
+}
+
+func newSessionToken() ([32]byte, error) {
+	var token [32]byte
+	_, err := rand.Read(token[:])
+	return token, err
+}
+
+// Ping asks a member of a room whether they are still there, remembering
+// the nonce so only an answer to this ping counts.
+func (s *Server) Ping(room *ChatRoom, client *RemoteClient) error {
+	var nonce [32]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+	room.Lock()
+	client.pingNonce = nonce
+	room.Unlock()
+	ping := PingMessage{RoomMessage{room.name}, nonce}
+	payload, err := ping.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	m := &Message{RawMessage{nil, payload}, PING, false, uint16(len(payload))}
+	data, err := m.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = s.Conn.WriteToUDP(data, client.address)
+	return err
+}
+
+// checkUptime evicts a member who has stopped answering, or pings them
+// and checks again after the ping interval. It runs on the timer wheel, and
+// stops once the member has left.
+func (s *Server) checkUptime(room *ChatRoom, client *RemoteClient) {
+	room.Lock()
+	if room.clients[client.address.String()] != client {
+		room.Unlock()
+		log.Info(client.address, " already left")
+		return
+	}
+	if client.lastSeen.Before(time.Now().Add(-s.Config.Timeout)) || client.checkCount > s.Config.MaxMissedPings {
+		delete(room.clients, client.address.String())
+		room.Unlock()
+		log.Info(client.address, " disconnected")
+		s.broadcastPresence(room, client, PRESENCE_TIMED_OUT)
+		s.dropIfEmpty(room)
+		return
+	}
+	log.Info("Last seen ", client.lastSeen)
+	client.checkCount += 1
+	room.Unlock()
+	err := s.Ping(room, client)
+	if err != nil {
+		log.Errorf("Ping to %v: %v", client.address, err)
+	}
+	s.wheel.schedule(s.Config.PingInterval, func() { s.checkUptime(room, client) })
+}
+
+// broadcastPresence tells everyone left in a room what happened to client.
+func (s *Server) broadcastPresence(room *ChatRoom, client *RemoteClient, event PresenceEvent) {
+	presence := PresenceMessage{RoomMessage{room.name}, event, *client.address, client.name}
+	payload, err := presence.EncodeMessage()
+	if err != nil {
+		log.Errorf("Presence for %v: %v", client.address, err)
+		return
+	}
+	message := &Message{RawMessage{nil, payload}, PRESENCE, false, uint16(len(payload))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		log.Errorf("Presence for %v: %v", client.address, err)
+		return
+	}
+	for _, address := range room.addresses() {
+		err = s.send(data, address)
+		if err != nil {
+			log.Errorf("Presence to %v: %v", address, err)
+		}
+	}
+}
+
+// PongReceived marks a member as still there, if the pong comes from them,
+// answers the last ping we sent them in that room, and proves they hold
+// the room's session token.
+func (s *Server) PongReceived(message Message) error {
+	var pong PongMessage
+	err := pong.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	room := s.room(pong.Room)
+	if room == nil {
+		return NotInRoomError
+	}
+	room.Lock()
+	defer room.Unlock()
+	client := room.clients[message.Sender().String()]
+	if client == nil {
+		return NotInRoomError
+	}
+	var unused [32]byte
+	want := pongProof(client.token, client.pingNonce, pong.Room)
+	if client.pingNonce == unused || !hmac.Equal(client.pingNonce[:], pong.Nonce[:]) || !hmac.Equal(want[:], pong.Proof[:]) {
+		return StalePongError
+	}
+	log.Info("Got pong from ", message.Sender())
+	client.pingNonce = unused
+	client.Uptime = Uptime{time.Now(), 0}
+	return nil
+}
+
+// PingReceived answers the server's ping for a room we are in.
+func (c *Client) PingReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var ping PingMessage
+	err := ping.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	log.Infof("Ping from %v for %s", message.Sender(), ping.Room)
+	return c.Pong(ping.Room, ping.Nonce)
+}
+
+// Pong answers a ping with proof that we hold the room's session token.
+func (c *Client) Pong(roomName string, nonce [32]byte) error {
+	c.lock.Lock()
+	token, ok := c.tokens[roomName]
+	c.lock.Unlock()
+	if !ok {
+		return NotInRoomError
+	}
+	pong := PongMessage{RoomMessage{roomName}, nonce, pongProof(token, nonce, roomName)}
+	payload, err := pong.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	m := &Message{RawMessage{nil, payload}, PONG, false, uint16(len(payload))}
+	data, err := m.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, c.middleMan)
+	return err
+}
+
+// PresenceReceived drops a peer the server has evicted from a room, rather
+// than waiting for the next room list.
+func (c *Client) PresenceReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var presence PresenceMessage
+	err := presence.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	peers, ok := c.rooms[presence.Room]
+	if !ok {
+		c.lock.Unlock()
+		return NotInRoomError
+	}
+	remaining := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.UDPAddr.String() != presence.Address.String() {
+			remaining = append(remaining, peer)
+		}
+	}
+	c.rooms[presence.Room] = remaining
+	c.lock.Unlock()
+	log.Infof("%v %v in %s", presence.Address, presence.Event, presence.Room)
+	c.membersChanged(presence.Room)
+	c.forgetReliable()
+	c.notify(presence.Room, fmt.Sprintf("%s %v", presence.Name, presence.Event))
+	return nil
+}
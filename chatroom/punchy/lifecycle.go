@@ -0,0 +1,76 @@
+package punchy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ClosedError = errors.New("Already closed")
+
+// lifecycle tracks the goroutines a Client or Server starts, so that Close
+// can stop every one of them and wait for them to finish.
+type lifecycle struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// spawn runs f in a goroutine that stop waits for. Once stopping has begun
+// nothing new is started and spawn returns false.
+func (l *lifecycle) spawn(f func()) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return false
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// done is closed when stopping begins. Anything that blocks should also
+// select on it.
+func (l *lifecycle) done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+// sleep waits for d, or returns false early if we are stopping.
+func (l *lifecycle) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// stop cancels everything, calls release to unblock anything stuck in a
+// read, then waits for every spawned goroutine. Only the first call does
+// anything; it must not be made from a spawned goroutine.
+func (l *lifecycle) stop(release func() error) error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.Unlock()
+	l.cancel()
+	err := release()
+	l.wg.Wait()
+	return err
+}
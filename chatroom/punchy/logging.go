@@ -2,6 +2,7 @@ package punchy
 
 import (
 	"os"
+	"sync"
 
 	"github.com/op/go-logging"
 )
@@ -18,12 +19,24 @@ func init() {
 	logging.SetBackend(formatter)
 }
 
-func initServerLogging() {
+// serverLogging makes sure the backend is only swapped once, however many
+// servers are started; swapping it races with anything already logging.
+// serverLoggingError is what went wrong the one time, for every server.
+var serverLogging sync.Once
+var serverLoggingError error
+
+func setUpServerLogging() error {
+	serverLogging.Do(func() { serverLoggingError = initServerLogging() })
+	return serverLoggingError
+}
+
+// initServerLogging logs to server.log as well as stdout. The file stays
+// open for as long as the process logs to it.
+func initServerLogging() error {
 	f, err := os.OpenFile("server.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		return err
 	}
-	defer f.Close()
 	backend := logging.NewLogBackend(os.Stdout, "", 0)
 	file_backend := logging.NewLogBackend(f, "", 0)
 	var format = logging.MustStringFormatter(
@@ -33,4 +46,5 @@ func initServerLogging() {
 	formatted_file_backend := logging.NewBackendFormatter(file_backend, format)
 
 	logging.SetBackend(formatter, formatted_file_backend)
+	return nil
 }
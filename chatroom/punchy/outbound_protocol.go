@@ -1,8 +1,6 @@
 package punchy
 
 import (
-	"bytes"
-	"encoding/gob"
 	"net"
 )
 
@@ -11,21 +9,29 @@ type OutboundMessage interface {
 }
 
 func (m *RoomMessage) RawMessage() (RawMessage, error) {
-	w := new(bytes.Buffer)
 	var raw RawMessage
-	encoder := gob.NewEncoder(w)
-	err := encoder.Encode(m.Room)
-	if err != nil {
-		return raw, err
-	}
-	raw.Data = w.Bytes()
-	return raw, nil
+	data, err := m.EncodeMessage()
+	raw.Data = data
+	return raw, err
 }
 
+// RoomListMessage tells a member who else is in the room. Nick is the name
+// the server gave the member themselves, which may differ from the one they
+// asked for. Each member's Identity, Signature and the name they Requested
+// are passed on from their join, so members can check the server has not
+// swapped their keys or names. Token
+// is the member's own session token, for answering pings in the room.
 type RoomListMessage struct {
 	RoomMessage
-	Length    uint16
-	Addresses []net.UDPAddr
+	Length     uint16
+	Addresses  []net.UDPAddr
+	Keys       [][32]byte
+	Names      []string
+	Requested  []string
+	Identities [][32]byte
+	Signatures [][64]byte
+	Nick       string
+	Token      [32]byte
 }
 
 func (m *RoomListMessage) RawMessage() (RawMessage, error) {
@@ -35,46 +41,110 @@ func (m *RoomListMessage) RawMessage() (RawMessage, error) {
 	return raw, err
 }
 func (m *RoomListMessage) EncodeMessage() ([]byte, error) {
-	w := new(bytes.Buffer)
-	enc := gob.NewEncoder(w)
-	err := enc.Encode(m.Length)
-	if err != nil {
-		panic(err)
-	}
-	err = enc.Encode(m.Room)
-	if err != nil {
-		panic(err)
-	}
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putString(m.Nick)
+	w.putKey(m.Token)
+	w.putUint16(m.Length)
 	for i := uint16(0); i < m.Length; i++ {
-		err = enc.Encode(&m.Addresses[i])
-		if err != nil {
-			panic(err)
-		}
-	}
-	if err != nil {
-		panic(err)
+		w.putAddress(&m.Addresses[i])
+		w.putKey(m.Keys[i])
+		w.putString(m.Names[i])
+		w.putString(m.Requested[i])
+		w.putKey(m.Identities[i])
+		w.putSignature(m.Signatures[i])
 	}
-	return w.Bytes(), nil
+	return w.bytes()
 }
 
 func (m *RoomListMessage) DecodeMessage(buf []byte) error {
-	r := bytes.NewBuffer(buf)
-	decoder := gob.NewDecoder(r)
-	err := decoder.Decode(&m.Length)
-	if err != nil {
-		panic(err)
-	}
-	err = decoder.Decode(&m.Room)
-	if err != nil {
-		panic(err)
-	}
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Nick = r.getString()
+	m.Token = r.getKey()
+	// Each member is at least an IPv4 address, a key, two empty names, an
+	// identity and a signature.
+	m.Length = uint16(r.getCount(1 + net.IPv4len + 2 + 32 + 2 + 2 + 32 + 64))
 	m.Addresses = make([]net.UDPAddr, m.Length)
+	m.Keys = make([][32]byte, m.Length)
+	m.Names = make([]string, m.Length)
+	m.Requested = make([]string, m.Length)
+	m.Identities = make([][32]byte, m.Length)
+	m.Signatures = make([][64]byte, m.Length)
 	for i := uint16(0); i < m.Length; i++ {
-		err = decoder.Decode(&m.Addresses[i])
-		if err != nil {
-			panic(err)
-		}
+		m.Addresses[i] = r.getAddress()
+		m.Keys[i] = r.getKey()
+		m.Names[i] = r.getString()
+		m.Requested[i] = r.getString()
+		m.Identities[i] = r.getKey()
+		m.Signatures[i] = r.getSignature()
 	}
+	return r.done()
+}
+
+type MiddleManMessage struct {
+	PublicAddress net.UDPAddr
+	SessionID     uint32
+	Relay         bool
+}
+
+func (m *MiddleManMessage) RawMessage() (RawMessage, error) {
+	var raw RawMessage
+	data, err := m.EncodeMessage()
+	raw.Data = data
+	return raw, err
+}
 
-	return nil
+func (m *MiddleManMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putAddress(&m.PublicAddress)
+	w.putUint32(m.SessionID)
+	w.putBool(m.Relay)
+	return w.bytes()
+}
+
+func (m *MiddleManMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.PublicAddress = r.getAddress()
+	m.SessionID = r.getUint32()
+	m.Relay = r.getBool()
+	return r.done()
+}
+
+// PunchScheduleMessage tells a client to start punching the given addresses
+// after Delay milliseconds. The server sends it to both ends of every new pair
+// at the same moment so their probes cross.
+type PunchScheduleMessage struct {
+	RoomMessage
+	Delay     uint16
+	Addresses []net.UDPAddr
+}
+
+func (m *PunchScheduleMessage) RawMessage() (RawMessage, error) {
+	var raw RawMessage
+	data, err := m.EncodeMessage()
+	raw.Data = data
+	return raw, err
+}
+
+func (m *PunchScheduleMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint16(m.Delay)
+	w.putLength(len(m.Addresses))
+	for i := range m.Addresses {
+		w.putAddress(&m.Addresses[i])
+	}
+	return w.bytes()
+}
+
+func (m *PunchScheduleMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.Delay = r.getUint16()
+	m.Addresses = make([]net.UDPAddr, r.getCount(1+net.IPv4len+2))
+	for i := range m.Addresses {
+		m.Addresses[i] = r.getAddress()
+	}
+	return r.done()
 }
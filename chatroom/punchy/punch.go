@@ -0,0 +1,152 @@
+package punchy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const punchInterval = 250 * time.Millisecond
+const punchAttempts = 20
+
+type PeerState uint8
+
+const (
+	PeerPunching PeerState = iota
+	PeerConnected
+	PeerFailed
+	PeerRelayed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerPunching:
+		return "punching"
+	case PeerConnected:
+		return "connected"
+	case PeerFailed:
+		return "failed"
+	case PeerRelayed:
+		return "relayed"
+	}
+	return "unknown"
+}
+
+func (p *Peer) State() PeerState {
+	return p.state
+}
+
+// PunchScheduled starts punching the peers the server has told us about.
+func (c *Client) PunchScheduled(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var schedule PunchScheduleMessage
+	err := schedule.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	c.life.spawn(func() { c.Punch(schedule) })
+	return nil
+}
+
+// Punch waits for the delay the server asked for, then probes every address
+// in the schedule until it answers or we run out of attempts.
+func (c *Client) Punch(schedule PunchScheduleMessage) {
+	log.Infof("Punching %d peers in room %s", len(schedule.Addresses), schedule.Room)
+	if !c.life.sleep(time.Duration(schedule.Delay) * time.Millisecond) {
+		return
+	}
+
+	announced := make(map[string]bool)
+	for attempt := 0; attempt < punchAttempts; attempt++ {
+		waiting := 0
+		for i := range schedule.Addresses {
+			addr := &schedule.Addresses[i]
+			if announced[addr.String()] {
+				continue
+			}
+			peer := c.findPeer(addr)
+			if peer != nil && peer.state == PeerConnected {
+				announced[addr.String()] = true
+				c.notify(schedule.Room, fmt.Sprintf("%v is reachable", addr))
+				continue
+			}
+			waiting++
+			err := c.sendPunch(PUNCH, schedule.Room, addr)
+			if err != nil {
+				c.reportError(err)
+			}
+		}
+		if waiting == 0 {
+			return
+		}
+		if !c.life.sleep(punchInterval) {
+			return
+		}
+	}
+
+	for i := range schedule.Addresses {
+		addr := &schedule.Addresses[i]
+		if announced[addr.String()] {
+			continue
+		}
+		peer := c.findPeer(addr)
+		if peer == nil {
+			continue
+		}
+		if peer.state == PeerConnected {
+			c.notify(schedule.Room, fmt.Sprintf("%v is reachable", addr))
+			continue
+		}
+		log.Warningf("Punching %v timed out", addr)
+		if c.RelayAvailable() {
+			c.setPeerState(addr, PeerRelayed)
+			c.notify(schedule.Room, fmt.Sprintf("%v is unreachable directly, relaying through the server", addr))
+		} else {
+			c.setPeerState(addr, PeerFailed)
+			c.notify(schedule.Room, fmt.Sprintf("%v is unreachable", addr))
+		}
+	}
+}
+
+func (c *Client) sendPunch(msgType MessageType, roomName string, addr *net.UDPAddr) error {
+	roomMessage := RoomMessage{roomName}
+	raw, err := roomMessage.RawMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{raw, msgType, false, uint16(len(raw.Data))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// PunchReceived handles a probe or its acknowledgement from a peer. Either
+// one means the path between us is open.
+func (c *Client) PunchReceived(message Message) error {
+	if message.Type() == PUNCH {
+		var room RoomMessage
+		err := room.DecodeMessage(message.Data)
+		if err != nil {
+			return err
+		}
+		err = c.sendPunch(PUNCH_ACK, room.Room, message.Sender())
+		if err != nil {
+			return err
+		}
+	}
+	peer := c.findPeer(message.Sender())
+	if peer == nil {
+		log.Infof("Punch from unknown peer %v", message.Sender())
+		return nil
+	}
+	c.sawPeer(message.Sender(), 0)
+	if c.setPeerState(message.Sender(), PeerConnected) != PeerConnected {
+		log.Infof("Connected to %v", message.Sender())
+	}
+	return nil
+}
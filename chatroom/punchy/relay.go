@@ -0,0 +1,158 @@
+package punchy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DEFAULT_RELAY_LIMIT is how many bytes a second each client may push through
+// the server when relaying is on.
+const DEFAULT_RELAY_LIMIT = 16 * 1024
+
+var NotRelayableError = errors.New("Message type cannot be relayed")
+
+// relayable is what a peer may send us through the server: chat, its
+// acknowledgements, file transfers and signals. Punches in particular are
+// not, since one arriving through the server says nothing about whether
+// the peer can reach us directly.
+var relayable = map[MessageType]bool{
+	ROOM_MESSAGE:     true,
+	PRIVATE_MESSAGE:  true,
+	RELIABLE_MESSAGE: true,
+	ACK:              true,
+	FILE_OFFER:       true,
+	FILE_ACCEPT:      true,
+	FILE_REJECT:      true,
+	FILE_CHUNK:       true,
+	TYPING:           true,
+	READ_RECEIPT:     true,
+}
+
+type relayBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow refills the bucket for the time since it was last used and takes
+// size bytes out of it if there are enough.
+func (b *relayBucket) allow(size int, limit int) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.updated).Seconds() * float64(limit)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.updated = now
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens -= float64(size)
+	return true
+}
+
+// pruneRelayBuckets forgets senders whose buckets have had time to refill,
+// which is no different from never having seen them. It runs on the timer
+// wheel every ping interval.
+func (s *Server) pruneRelayBuckets() {
+	s.lock.Lock()
+	for sender, bucket := range s.relayBuckets {
+		if time.Since(bucket.updated) > time.Second {
+			delete(s.relayBuckets, sender)
+		}
+	}
+	s.lock.Unlock()
+	s.wheel.schedule(s.Config.PingInterval, s.pruneRelayBuckets)
+}
+
+func (s *Server) shareRoom(a, b *net.UDPAddr) bool {
+	for _, room := range s.roomsNow() {
+		if room.member(a) && room.member(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayToPeer forwards a wrapped message to another member of one of the
+// sender's rooms, for peers that could not punch through to each other.
+func (s *Server) RelayToPeer(message Message) error {
+	sender := message.Sender()
+	if !s.Relay {
+		log.Warningf("Relaying disabled, dropping message from %v", sender)
+		return nil
+	}
+	var relay RelayMessage
+	err := relay.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	target := relay.Peer
+	if !s.shareRoom(sender, &target) {
+		log.Warningf("%v tried to relay to %v outside its rooms", sender, &target)
+		return NotInRoomError
+	}
+	s.lock.Lock()
+	bucket := s.relayBuckets[sender.String()]
+	if bucket == nil {
+		bucket = &relayBucket{float64(s.RelayLimit), time.Now()}
+		s.relayBuckets[sender.String()] = bucket
+	}
+	allowed := bucket.allow(len(relay.Payload), s.RelayLimit)
+	s.lock.Unlock()
+	if !allowed {
+		log.Warningf("Relay limit hit for %v", sender)
+		return nil
+	}
+	relay.Peer = *sender
+	data, err := relay.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	forward := &Message{RawMessage{nil, data}, RELAY_MESSAGE, false, uint16(len(data))}
+	data, err = forward.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return s.send(data, &target)
+}
+
+// sendToPeer writes an encoded message to a peer, going through the server
+// if we could not punch through to them.
+func (c *Client) sendToPeer(peer *Peer, data []byte) (int, error) {
+	if peer.state != PeerRelayed {
+		return c.send(data, &peer.UDPAddr)
+	}
+	relay := RelayMessage{peer.UDPAddr, data}
+	relayData, err := relay.EncodeMessage()
+	if err != nil {
+		return 0, err
+	}
+	message := &Message{RawMessage{nil, relayData}, RELAY_MESSAGE, false, uint16(len(relayData))}
+	relayData, err = message.EncodeMessage()
+	if err != nil {
+		return 0, err
+	}
+	return c.send(relayData, c.middleMan)
+}
+
+// RelayReceived unwraps a message the server relayed for a peer and handles
+// it as though it had come from them directly.
+func (c *Client) RelayReceived(message Message) error {
+	if message.Sender().String() != c.middleMan.String() {
+		return UnexpectedSenderError
+	}
+	var relay RelayMessage
+	err := relay.DecodeMessage(message.Data)
+	if err != nil {
+		return err
+	}
+	var inner Message
+	err = inner.DecodeMessage(&relay.Peer, relay.Payload)
+	if err != nil {
+		return err
+	}
+	if !relayable[inner.Type()] {
+		return NotRelayableError
+	}
+	return c.handleMessage(inner)
+}
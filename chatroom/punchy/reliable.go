@@ -0,0 +1,493 @@
+package punchy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const retransmitInitial = 300 * time.Millisecond
+const retransmitMax = 5 * time.Second
+const retransmitAttempts = 8
+const retransmitTick = 100 * time.Millisecond
+
+// reorderWindow is how far ahead of the next expected message we will hold
+// messages for one peer. Anything further ahead is not acknowledged, so the
+// sender tries again later.
+const reorderWindow = 64
+
+// ReliableMessage wraps an encoded Message with a sequence number, and is
+// sealed with the key shared with the peer so none of it can be forged.
+// Epoch is picked afresh whenever the sender starts counting from 1 again,
+// so the receiver knows to as well. Low is the lowest sequence number the
+// sender is still trying to deliver: everything before it has arrived or
+// been given up on, so the receiver need not wait for it.
+type ReliableMessage struct {
+	Epoch   uint32
+	Seq     uint32
+	Low     uint32
+	Payload []byte
+}
+
+// AckMessage says every message up to and including Seq in Epoch has been
+// delivered, in order. It is sealed like a ReliableMessage.
+type AckMessage struct {
+	Epoch uint32
+	Seq   uint32
+}
+
+// Delivery reports whether a chat message we sent reached one peer.
+type Delivery struct {
+	Room      string
+	ID        uint32
+	Peer      string
+	Delivered bool
+}
+
+type pendingMessage struct {
+	data     []byte
+	room     string
+	id       uint32
+	peer     string
+	attempts int
+	backoff  time.Duration
+	next     time.Time
+}
+
+// reliablePeer is the sequencing state for one peer, in both directions.
+// sendEpoch and nextSeq number what we send; epoch and expected track what
+// they send us.
+type reliablePeer struct {
+	addr      net.UDPAddr
+	sendEpoch uint32
+	nextSeq   uint32
+	pending   map[uint32]*pendingMessage
+	epoch     uint32
+	expected  uint32
+	buffered  map[uint32]Message
+}
+
+// reliability is the state for every peer we share a room with. Peers
+// are only added once a sealed message shows they are who they say, and
+// are dropped when we no longer share a room.
+type reliability struct {
+	sync.Mutex
+	peers map[string]*reliablePeer
+}
+
+func (m *ReliableMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.Epoch)
+	w.putUint32(m.Seq)
+	w.putUint32(m.Low)
+	w.putBytes(m.Payload)
+	return w.bytes()
+}
+
+func (m *ReliableMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Epoch = r.getUint32()
+	m.Seq = r.getUint32()
+	m.Low = r.getUint32()
+	m.Payload = r.getBytes()
+	return r.done()
+}
+
+func (m *AckMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.Epoch)
+	w.putUint32(m.Seq)
+	return w.bytes()
+}
+
+func (m *AckMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Epoch = r.getUint32()
+	m.Seq = r.getUint32()
+	return r.done()
+}
+
+func newReliability() *reliability {
+	return &reliability{peers: make(map[string]*reliablePeer)}
+}
+
+func randomEpoch() uint32 {
+	var epoch [4]byte
+	rand.Read(epoch[:])
+	return binary.BigEndian.Uint32(epoch[:])
+}
+
+// peer is the state for a peer, made if this is the first we have heard of
+// them. Callers must know the peer is in one of our rooms. The lock must be
+// held.
+func (r *reliability) peer(addr *net.UDPAddr) *reliablePeer {
+	peer := r.peers[addr.String()]
+	if peer == nil {
+		peer = &reliablePeer{
+			addr:      *addr,
+			sendEpoch: randomEpoch(),
+			nextSeq:   1,
+			pending:   make(map[uint32]*pendingMessage),
+			expected:  1,
+			buffered:  make(map[uint32]Message),
+		}
+		r.peers[addr.String()] = peer
+	}
+	return peer
+}
+
+// low is the lowest sequence number we are still trying to deliver.
+func (state *reliablePeer) low() uint32 {
+	low := state.nextSeq
+	for seq := range state.pending {
+		if seq < low {
+			low = seq
+		}
+	}
+	return low
+}
+
+// wrap seals data as the sequenced message seq for peer. It is done afresh
+// for every resend, so the peer always hears our latest low. The lock must
+// be held.
+func (state *reliablePeer) wrap(peer *Peer, seq uint32, data []byte) ([]byte, error) {
+	if peer.sharedKey == [32]byte{} {
+		return nil, MissingKeyError
+	}
+	reliableMessage := ReliableMessage{state.sendEpoch, seq, state.low(), data}
+	payload, err := reliableMessage.EncodeMessage()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := Seal(peer.sharedKey, payload)
+	if err != nil {
+		return nil, err
+	}
+	message := &Message{RawMessage{nil, sealed}, RELIABLE_MESSAGE, true, uint16(len(sealed))}
+	return message.EncodeMessage()
+}
+
+// EnableReliable turns on acknowledgements, retransmission and in-order
+// delivery for chat messages. Both ends need it on.
+func (c *Client) EnableReliable() {
+	c.lock.Lock()
+	if c.reliable != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.reliable = newReliability()
+	c.lock.Unlock()
+	c.life.spawn(c.Retransmit)
+}
+
+// reliability is nil until EnableReliable is called.
+func (c *Client) reliability() *reliability {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.reliable
+}
+
+func (c *Client) Deliveries() chan Delivery {
+	return c.deliveryChannel
+}
+
+func (c *Client) reportDelivery(delivery Delivery) {
+	select {
+	case c.deliveryChannel <- delivery:
+	default:
+		log.Warning("Delivery channel full, dropping delivery report")
+	}
+}
+
+// sendReliable sends an encoded message to a peer with the next sequence
+// number, and keeps it until the peer acknowledges it.
+func (c *Client) sendReliable(peer *Peer, data []byte, roomName string, id uint32) error {
+	reliable := c.reliability()
+	reliable.Lock()
+	state := reliable.peer(&peer.UDPAddr)
+	seq := state.nextSeq
+	state.pending[seq] = &pendingMessage{data, roomName, id, peer.Name(), 1, retransmitInitial, time.Now().Add(retransmitInitial)}
+	state.nextSeq++
+	wrapped, err := state.wrap(peer, seq, data)
+	if err != nil {
+		delete(state.pending, seq)
+		reliable.Unlock()
+		return err
+	}
+	reliable.Unlock()
+	_, err = c.sendToPeer(peer, wrapped)
+	return err
+}
+
+// Retransmit resends anything that has not been acknowledged in time,
+// backing off each attempt, and gives up after retransmitAttempts.
+func (c *Client) Retransmit() {
+	reliable := c.reliability()
+	ticker := time.NewTicker(retransmitTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.life.done():
+			return
+		}
+		now := time.Now()
+		type resend struct {
+			addr net.UDPAddr
+			seq  uint32
+		}
+		resends := make([]resend, 0)
+		failed := make([]Delivery, 0)
+		reliable.Lock()
+		for _, state := range reliable.peers {
+			for seq, pending := range state.pending {
+				if pending.next.After(now) {
+					continue
+				}
+				if pending.attempts >= retransmitAttempts {
+					delete(state.pending, seq)
+					failed = append(failed, Delivery{pending.room, pending.id, pending.peer, false})
+					continue
+				}
+				pending.attempts++
+				pending.backoff *= 2
+				if pending.backoff > retransmitMax {
+					pending.backoff = retransmitMax
+				}
+				pending.next = now.Add(pending.backoff)
+				resends = append(resends, resend{state.addr, seq})
+			}
+		}
+		reliable.Unlock()
+		for _, r := range resends {
+			peer := c.findPeer(&r.addr)
+			if peer == nil {
+				continue
+			}
+			reliable.Lock()
+			state := reliable.peers[r.addr.String()]
+			var pending *pendingMessage
+			if state != nil {
+				pending = state.pending[r.seq]
+			}
+			if pending == nil {
+				// Acknowledged since we looked.
+				reliable.Unlock()
+				continue
+			}
+			data, err := state.wrap(peer, r.seq, pending.data)
+			reliable.Unlock()
+			if err != nil {
+				c.reportError(err)
+				continue
+			}
+			log.Infof("Retransmitting to %v", &r.addr)
+			_, err = c.sendToPeer(peer, data)
+			if err != nil {
+				c.reportError(err)
+			}
+		}
+		for _, delivery := range failed {
+			log.Warningf("Giving up on message %d to %s", delivery.ID, delivery.Peer)
+			c.reportDelivery(delivery)
+		}
+	}
+}
+
+// receive files a message from the peer, or with inner nil only takes note
+// of its epoch and low, and returns whatever can now be handed on in order.
+// The lock must be held.
+func (state *reliablePeer) receive(reliableMessage ReliableMessage, inner *Message) []Message {
+	if state.epoch != reliableMessage.Epoch {
+		state.epoch = reliableMessage.Epoch
+		state.expected = 1
+		state.buffered = make(map[uint32]Message)
+	}
+	ready := make([]Message, 0)
+	// The sender has stopped trying to deliver anything before low, so
+	// stop waiting for it, passing on whatever of it we do have.
+	if reliableMessage.Low > state.expected {
+		skipped := make([]uint32, 0)
+		for seq := range state.buffered {
+			if seq < reliableMessage.Low {
+				skipped = append(skipped, seq)
+			}
+		}
+		sort.Slice(skipped, func(i, j int) bool { return skipped[i] < skipped[j] })
+		for _, seq := range skipped {
+			ready = append(ready, state.buffered[seq])
+			delete(state.buffered, seq)
+		}
+		log.Warningf("Skipping messages %d to %d from %v, they were given up on", state.expected, reliableMessage.Low-1, &state.addr)
+		state.expected = reliableMessage.Low
+	}
+	seq := reliableMessage.Seq
+	if seq >= state.expected+reorderWindow {
+		log.Warningf("Message %d from %v is too far ahead, waiting for a resend", seq, &state.addr)
+	} else if seq >= state.expected && inner != nil {
+		state.buffered[seq] = *inner
+	}
+	for {
+		next, ok := state.buffered[state.expected]
+		if !ok {
+			break
+		}
+		delete(state.buffered, state.expected)
+		ready = append(ready, next)
+		state.expected++
+	}
+	return ready
+}
+
+// acknowledge drops everything up to and including seq from pending, and
+// reports it delivered in the order it was sent. The lock must be held.
+func (state *reliablePeer) acknowledge(seq uint32) []Delivery {
+	acked := make([]uint32, 0)
+	for pendingSeq := range state.pending {
+		if pendingSeq <= seq {
+			acked = append(acked, pendingSeq)
+		}
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i] < acked[j] })
+	delivered := make([]Delivery, 0, len(acked))
+	for _, pendingSeq := range acked {
+		pending := state.pending[pendingSeq]
+		delete(state.pending, pendingSeq)
+		delivered = append(delivered, Delivery{pending.room, pending.id, pending.peer, true})
+	}
+	return delivered
+}
+
+// ReliableReceived hands a sequenced message, and any it was holding up,
+// to handleMessage in order, then acknowledges everything delivered so far.
+// Messages waiting on a gap are held but not acknowledged, so they are
+// only marked delivered once they are shown. Duplicates are acknowledged
+// again but not delivered twice.
+func (c *Client) ReliableReceived(message Message) error {
+	reliable := c.reliability()
+	if reliable == nil {
+		log.Warningf("Reliable message from %v but reliability is off", message.Sender())
+		return nil
+	}
+	peer, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var reliableMessage ReliableMessage
+	err = reliableMessage.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	sender := &peer.UDPAddr
+	inner := new(Message)
+	err = inner.DecodeMessage(sender, reliableMessage.Payload)
+	if err == nil && inner.Type() == RELIABLE_MESSAGE {
+		err = UnexpectedSenderError
+	}
+	if err != nil {
+		// Its epoch and low still count.
+		inner = nil
+	}
+	reliable.Lock()
+	state := reliable.peer(sender)
+	ready := state.receive(reliableMessage, inner)
+	delivered := state.expected - 1
+	epoch := state.epoch
+	reliable.Unlock()
+
+	if delivered > 0 {
+		ackErr := c.sendAck(peer, epoch, delivered)
+		if ackErr != nil {
+			c.reportError(ackErr)
+		}
+	}
+	for i := range ready {
+		handleErr := c.handleMessage(ready[i])
+		if handleErr != nil {
+			c.dropPacket(&ready[i], handleErr)
+		}
+	}
+	return err
+}
+
+func (c *Client) sendAck(peer *Peer, epoch, seq uint32) error {
+	ack := AckMessage{epoch, seq}
+	payload, err := ack.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return c.sendSealed(peer, ACK, payload)
+}
+
+// AckReceived marks everything up to the acknowledged message delivered.
+func (c *Client) AckReceived(message Message) error {
+	reliable := c.reliability()
+	if reliable == nil {
+		return nil
+	}
+	peer, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var ack AckMessage
+	err = ack.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	reliable.Lock()
+	state := reliable.peers[peer.UDPAddr.String()]
+	if state == nil || ack.Epoch != state.sendEpoch {
+		reliable.Unlock()
+		return nil
+	}
+	delivered := state.acknowledge(ack.Seq)
+	reliable.Unlock()
+	for _, delivery := range delivered {
+		c.reportDelivery(delivery)
+	}
+	return nil
+}
+
+// forgetReliable drops the state for peers we no longer share a room with,
+// failing anything still on its way to them. Should they come back, both
+// ends start counting again in a new epoch.
+func (c *Client) forgetReliable() {
+	reliable := c.reliability()
+	if reliable == nil {
+		return
+	}
+	reliable.Lock()
+	addrs := make([]net.UDPAddr, 0, len(reliable.peers))
+	for _, state := range reliable.peers {
+		addrs = append(addrs, state.addr)
+	}
+	reliable.Unlock()
+	gone := make([]string, 0)
+	for i := range addrs {
+		if c.findPeer(&addrs[i]) == nil {
+			gone = append(gone, addrs[i].String())
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+	failed := make([]Delivery, 0)
+	reliable.Lock()
+	for _, key := range gone {
+		state := reliable.peers[key]
+		if state == nil {
+			continue
+		}
+		for _, pending := range state.pending {
+			failed = append(failed, Delivery{pending.room, pending.id, pending.peer, false})
+		}
+		delete(reliable.peers, key)
+	}
+	reliable.Unlock()
+	for _, delivery := range failed {
+		c.reportDelivery(delivery)
+	}
+}
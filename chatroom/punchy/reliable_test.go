@@ -0,0 +1,94 @@
+package punchy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// TestReliableReceive files sequenced messages with one peer's state and
+// checks what is handed on, in what order, and what would be acknowledged.
+func TestReliableReceive(t *testing.T) {
+	type arrival struct {
+		epoch, seq, low uint32
+	}
+	cases := []struct {
+		name     string
+		arrivals []arrival
+		// delivered is the sequence numbers handed on, in order.
+		delivered []uint32
+		// acked is the last sequence number delivered in order.
+		acked uint32
+	}{
+		{"in order", []arrival{{1, 1, 1}, {1, 2, 1}, {1, 3, 1}}, []uint32{1, 2, 3}, 3},
+		{"reordered", []arrival{{1, 3, 1}, {1, 1, 1}, {1, 2, 1}}, []uint32{1, 2, 3}, 3},
+		{"duplicates", []arrival{{1, 1, 1}, {1, 1, 1}, {1, 2, 1}, {1, 1, 1}, {1, 2, 1}}, []uint32{1, 2}, 2},
+		{"held behind a gap", []arrival{{1, 2, 1}, {1, 3, 1}}, nil, 0},
+		{"gap given up on", []arrival{{1, 2, 1}, {1, 3, 1}, {1, 4, 2}}, []uint32{2, 3, 4}, 4},
+		{"held past a skipped gap", []arrival{{1, 2, 1}, {1, 4, 3}}, []uint32{2}, 2},
+		{"low passes held messages", []arrival{{1, 3, 1}, {1, 5, 1}, {1, 6, 6}}, []uint32{3, 5, 6}, 6},
+		{"beyond the window", []arrival{{1, reorderWindow + 1, 1}, {1, 1, 1}}, []uint32{1}, 1},
+		{"new epoch starts again", []arrival{{1, 1, 1}, {1, 2, 1}, {2, 1, 1}}, []uint32{1, 2, 1}, 1},
+		{"new epoch drops held", []arrival{{1, 3, 1}, {2, 2, 1}, {2, 1, 1}}, []uint32{1, 2}, 2},
+		{"restarted far ahead", []arrival{{1, 500, 500}, {1, 501, 500}}, []uint32{500, 501}, 501},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newReliability().peer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+			delivered := make([]uint32, 0)
+			for _, a := range tc.arrivals {
+				inner := &Message{RawMessage{nil, []byte{byte(a.seq >> 8), byte(a.seq)}}, ROOM_MESSAGE, true, 2}
+				for _, message := range state.receive(ReliableMessage{a.epoch, a.seq, a.low, nil}, inner) {
+					delivered = append(delivered, uint32(message.Data[0])<<8|uint32(message.Data[1]))
+				}
+			}
+			if fmt.Sprint(delivered) != fmt.Sprint(append([]uint32{}, tc.delivered...)) {
+				t.Fatalf("delivered %v, want %v", delivered, tc.delivered)
+			}
+			if state.expected-1 != tc.acked {
+				t.Fatalf("would acknowledge %d, want %d", state.expected-1, tc.acked)
+			}
+		})
+	}
+}
+
+// TestReliableAcknowledge checks a cumulative acknowledgement clears and
+// reports every pending message up to it, in the order they were sent,
+// and moves low on.
+func TestReliableAcknowledge(t *testing.T) {
+	cases := []struct {
+		name    string
+		pending []uint32
+		ack     uint32
+		acked   []uint32
+		low     uint32
+	}{
+		{"nothing pending", nil, 3, nil, 6},
+		{"all", []uint32{1, 2, 3}, 3, []uint32{1, 2, 3}, 6},
+		{"some", []uint32{2, 3, 5}, 3, []uint32{2, 3}, 5},
+		{"again", []uint32{4, 5}, 3, nil, 4},
+		{"past the end", []uint32{4, 5}, 9, []uint32{4, 5}, 6},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newReliability().peer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+			state.nextSeq = 6
+			for _, seq := range tc.pending {
+				state.pending[seq] = &pendingMessage{id: seq}
+			}
+			acked := make([]uint32, 0)
+			for _, delivery := range state.acknowledge(tc.ack) {
+				if !delivery.Delivered {
+					t.Fatal("reported undelivered", delivery)
+				}
+				acked = append(acked, delivery.ID)
+			}
+			if fmt.Sprint(acked) != fmt.Sprint(append([]uint32{}, tc.acked...)) {
+				t.Fatalf("acknowledged %v, want %v", acked, tc.acked)
+			}
+			if state.low() != tc.low {
+				t.Fatalf("low is %d, want %d", state.low(), tc.low)
+			}
+		})
+	}
+}
@@ -1,27 +1,66 @@
 package punchy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
+// DEFAULT_NICK is who a client is if it joins without asking for a name.
+const DEFAULT_NICK = "guest"
+
+// punchDelay gives every member time to receive the new room list before
+// the probes start.
+const punchDelay = 500
+
 type ChatServer interface {
-	Serve()
+	Serve(context.Context) error
 	Encrypted() bool
 	AddUserToRoom(string *net.UDPAddr)
 }
 
 type Server struct {
+	// lock guards Rooms, sessions, relayBuckets, challenges and
+	// keptHistory. Each room guards its own members; take lock first if
+	// you need both.
+	lock  sync.Mutex
 	Port  int
 	Conn  *net.UDPConn
 	Rooms map[string]*ChatRoom
 	//	ActiveClients []ClientConnection
+	Relay        bool
+	RelayLimit   int
+	Access       map[string]RoomAccess // password or allow-list per room, set before Serve
+	Config       ServerConfig          // keepalive timings, as given to NewServer
+	wheel        *timerWheel
+	challenges   map[string]*roomChallenge
+	keys         *KeyPair
+	sessions     map[string]*session
+	nextSession  uint32
+	relayBuckets map[string]*relayBucket
+	keptHistory  map[string]*keptHistory
+	fragments    *reassembler
+	dropped      uint64
+	life         *lifecycle
 }
 
+// RemoteClient is a member of a room. requested, identity and signature
+// come from their join and are handed on to the rest of the room
+// untouched; name is what the server calls them. token is
+// the session token they prove they hold when answering a ping, and
+// pingNonce the nonce of the ping waiting on an answer.
 type RemoteClient struct {
 	address   *net.UDPAddr
 	sharedKey [32]byte
+	name      string
+	requested string
+	identity  [32]byte
+	signature [64]byte
+	token     [32]byte
+	pingNonce [32]byte
 	Uptime
 }
 
@@ -30,141 +69,509 @@ type Uptime struct {
 	checkCount int
 }
 
+// ChatRoom's lock guards its clients, their Uptime and its history. gone is
+// set once the room has emptied and been dropped from the server; anyone
+// still holding it must look the room up again.
 type ChatRoom struct {
-	clients     map[string]*RemoteClient
-	upTimeQueue chan *net.UDPAddr
-	pongQueue   chan *net.UDPAddr
+	sync.Mutex
+	name    string
+	clients map[string]*RemoteClient
+	history []HistoryEntry
+	gone    bool
 }
 
-func NewServer(port *int) Server {
-	initServerLogging()
-	return Server{*port, nil, make(map[string]*ChatRoom)}
+// NewServer sets up a server on port, ready to Serve. It fails if config
+// is not usable or the server log cannot be opened.
+func NewServer(port *int, config ServerConfig) (Server, error) {
+	err := config.validate()
+	if err != nil {
+		return Server{}, err
+	}
+	err = setUpServerLogging()
+	if err != nil {
+		return Server{}, err
+	}
+	return Server{
+		Port:         *port,
+		Rooms:        make(map[string]*ChatRoom),
+		RelayLimit:   DEFAULT_RELAY_LIMIT,
+		Config:       config,
+		wheel:        newTimerWheel(),
+		sessions:     make(map[string]*session),
+		relayBuckets: make(map[string]*relayBucket),
+		keptHistory:  make(map[string]*keptHistory),
+		challenges:   make(map[string]*roomChallenge),
+		fragments:    newReassembler(),
+		life:         newLifecycle(),
+	}, nil
 }
 
-func (s *Server) UpdateRoomList(roomName string, room *ChatRoom, client *net.UDPAddr) {
-	roomList := RoomListMessage{}
-	roomList.Length = 0
-	if len(room.clients) > 0 {
-		roomList.Length = uint16(len(room.clients) - 1)
+func (s *Server) UpdateRoomList(roomName string, room *ChatRoom, client *net.UDPAddr) error {
+	room.Lock()
+	roomList, member := room.list(roomName, client)
+	room.Unlock()
+	if !member {
+		// Evicted or gone since the broadcast started; they hear nothing.
+		return nil
+	}
+	raw, err := roomList.RawMessage()
+	if err != nil {
+		return err
+	}
+	// A big room's list can outgrow one datagram, so it is encoded for
+	// sending in fragments.
+	message := &Message{raw, ROOM_LIST, false, uint16(len(raw.Data))}
+	data, err := message.encodeFragmented()
+	if err != nil {
+		return err
+	}
+	err = s.send(data, client)
+	if err != nil {
+		return err
 	}
+	log.Info("Room list sent")
+	return nil
+}
+
+// list is the room as client should see it, built from whoever is in it
+// right now. It reports false if client is not one of them, as when they
+// have been evicted since a broadcast began. The room must be locked.
+func (room *ChatRoom) list(roomName string, client *net.UDPAddr) (RoomListMessage, bool) {
+	roomList := RoomListMessage{}
 	roomList.Room = roomName
-	roomList.Addresses = make([]net.UDPAddr, roomList.Length)
-	count := 0
+	member := false
 	for _, other := range room.clients {
 		if other.address.String() == client.String() {
+			roomList.Nick = other.name
+			roomList.Token = other.token
+			member = true
 			continue
 		}
-		roomList.Addresses[count] = *other.address
-		count++
+		roomList.Addresses = append(roomList.Addresses, *other.address)
+		roomList.Keys = append(roomList.Keys, other.sharedKey)
+		roomList.Names = append(roomList.Names, other.name)
+		roomList.Requested = append(roomList.Requested, other.requested)
+		roomList.Identities = append(roomList.Identities, other.identity)
+		roomList.Signatures = append(roomList.Signatures, other.signature)
 	}
-	raw, err := roomList.RawMessage()
-	if err != nil {
-		panic(err)
+	roomList.Length = uint16(len(roomList.Addresses))
+	return roomList, member
+}
+
+// addresses is who is in the room right now.
+func (room *ChatRoom) addresses() []*net.UDPAddr {
+	room.Lock()
+	defer room.Unlock()
+	addresses := make([]*net.UDPAddr, 0, len(room.clients))
+	for _, client := range room.clients {
+		addresses = append(addresses, client.address)
 	}
-	message := &Message{raw, ROOM_LIST, false, uint16(len(raw.Data))}
-	data, err := message.EncodeMessage()
-	if err != nil {
-		panic(err)
+	return addresses
+}
+
+func (room *ChatRoom) member(addr *net.UDPAddr) bool {
+	room.Lock()
+	defer room.Unlock()
+	return room.clients[addr.String()] != nil
+}
+
+// inAnyRoom reports whether addr is a member of any room.
+func (s *Server) inAnyRoom(addr *net.UDPAddr) bool {
+	for _, room := range s.roomsNow() {
+		if room.member(addr) {
+			return true
+		}
 	}
-	s.Conn.WriteTo(data, client)
-	log.Info("Room list sent")
-	if err != nil {
-		panic(err)
+	return false
+}
+
+// broadcastRoomList sends every member of a room the new room list.
+func (s *Server) broadcastRoomList(roomName string, room *ChatRoom) {
+	for _, address := range room.addresses() {
+		err := s.UpdateRoomList(roomName, room, address)
+		if err != nil {
+			log.Errorf("Room list to %v: %v", address, err)
+		}
+	}
+}
+
+// room looks up a room by name, or returns nil.
+func (s *Server) room(roomName string) *ChatRoom {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Rooms[roomName]
+}
+
+// roomsNow is every room there is right now.
+func (s *Server) roomsNow() []*ChatRoom {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rooms := make([]*ChatRoom, 0, len(s.Rooms))
+	for _, room := range s.Rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// uniqueName finds a name no one else in the room is using, adding a number
+// to the one asked for if need be. The room must be locked.
+func uniqueName(room *ChatRoom, client *RemoteClient) string {
+	name := client.requested
+	if name == "" {
+		name = DEFAULT_NICK
 	}
+	taken := func(candidate string) bool {
+		for _, other := range room.clients {
+			if other.name == candidate && other.address.String() != client.address.String() {
+				return true
+			}
+		}
+		return false
+	}
+	candidate := name
+	for i := 2; taken(candidate); i++ {
+		candidate = fmt.Sprintf("%s_%d", name, i)
+	}
+	return candidate
 }
 
-func (s *Server) AddToRoom(roomName string, room *ChatRoom, client *RemoteClient) {
+// AddToRoom adds a client to a room, or updates them if they are already in
+// it. It reports false, adding no one, if the room has been dropped.
+func (s *Server) AddToRoom(roomName string, room *ChatRoom, client *RemoteClient) bool {
+	room.Lock()
+	if room.gone {
+		room.Unlock()
+		return false
+	}
+	if existing := room.clients[client.address.String()]; existing != nil {
+		log.Info("Client rejoined room ", client.address.String())
+		existing.requested = client.requested
+		existing.name = uniqueName(room, client)
+		existing.sharedKey = client.sharedKey
+		existing.identity = client.identity
+		existing.signature = client.signature
+		room.Unlock()
+		s.broadcastRoomList(roomName, room)
+		return true
+	}
 	log.Info("Adding client to room", client.address.String())
+	client.name = uniqueName(room, client)
 	room.clients[client.address.String()] = client
-	room.upTimeQueue <- client.address
+	room.Unlock()
+	s.wheel.schedule(0, func() { s.checkUptime(room, client) })
 	log.Info("Handshake begins")
-	for _, client := range room.clients {
-		go s.UpdateRoomList(roomName, room, client.address)
+	s.broadcastRoomList(roomName, room)
+	s.SchedulePunch(roomName, room, client)
+	return true
+}
+
+// SchedulePunch asks the new client to punch every existing member, and each
+// existing member to punch the new client, starting at the same time.
+func (s *Server) SchedulePunch(roomName string, room *ChatRoom, client *RemoteClient) {
+	others := make([]net.UDPAddr, 0)
+	for _, other := range room.addresses() {
+		if other.String() == client.address.String() {
+			continue
+		}
+		others = append(others, *other)
+		err := s.sendPunchSchedule(roomName, other, []net.UDPAddr{*client.address})
+		if err != nil {
+			log.Errorf("Punch schedule to %v: %v", other, err)
+		}
 	}
+	if len(others) > 0 {
+		err := s.sendPunchSchedule(roomName, client.address, others)
+		if err != nil {
+			log.Errorf("Punch schedule to %v: %v", client.address, err)
+		}
+	}
+}
+
+func (s *Server) sendPunchSchedule(roomName string, client *net.UDPAddr, addresses []net.UDPAddr) error {
+	schedule := PunchScheduleMessage{RoomMessage{roomName}, punchDelay, addresses}
+	raw, err := schedule.RawMessage()
+	if err != nil {
+		return err
+	}
+	message := &Message{raw, PUNCH_SCHEDULE, false, uint16(len(raw.Data))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return s.send(data, client)
+}
+
+// RemoveFromRoom drops a client that has asked to leave and sends the
+// remaining members the new room list.
+func (s *Server) RemoveFromRoom(message Message) error {
+	var roomMessage RoomMessage
+	err := roomMessage.DecodeMessage(message.RawData())
+	if err != nil {
+		return err
+	}
+	room := s.room(roomMessage.Room)
+	if room == nil {
+		return NotInRoomError
+	}
+	room.Lock()
+	if room.clients[message.Sender().String()] == nil {
+		room.Unlock()
+		return NotInRoomError
+	}
+	log.Info("Removing client from room ", message.Sender().String())
+	delete(room.clients, message.Sender().String())
+	room.Unlock()
+	s.broadcastRoomList(roomMessage.Room, room)
+	s.dropIfEmpty(room)
+	return nil
+}
 
+// dropIfEmpty forgets a room once its last member has gone. Its history is
+// kept for HISTORY_RETENTION in case the room is made again.
+func (s *Server) dropIfEmpty(room *ChatRoom) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room.Lock()
+	defer room.Unlock()
+	if len(room.clients) > 0 || room.gone {
+		return
+	}
+	room.gone = true
+	if s.Rooms[room.name] == room {
+		delete(s.Rooms, room.name)
+		s.keepHistory(room)
+	}
+	log.Infof("Room %s is empty, dropping it", room.name)
 }
-func (s *Server) Ping(client *net.UDPAddr) {
-	m := &Message{RawMessage{nil, make([]byte, 0)}, PING, false, 0}
-	data, err := m.EncodeMessage()
+
+func (s *Server) ClientConnectToRoom(message Message) error {
+	var room ConnectRoomMessage
+	err := room.DecodeMessage(message.RawData())
 	if err != nil {
-		panic(err)
+		return err
+	}
+	// Names are shown to every member and written to their logs and
+	// known peers files, so only one short printable word will do.
+	if !validRoomName(room.Room) {
+		return InvalidRoomNameError
+	}
+	log.Infof("Request for room %s", room.Room)
+	if room.Name != "" && !validNick(room.Name) {
+		return s.reject(message.Sender(), room.Room, REJECT_BAD_NICK)
+	}
+	if !verifyJoin(room.Identity, room.Signature, room.Room, room.sharedKey, room.Name) {
+		log.Warningf("%v sent a badly signed join for %s", message.Sender(), room.Room)
+		return s.reject(message.Sender(), room.Room, REJECT_BAD_SIGNATURE)
+	}
+	if access := s.Access[room.Room]; access.protected() && !s.rejoining(message.Sender(), room) {
+		return s.challenge(message.Sender(), room, access)
 	}
-	s.Conn.WriteToUDP(data, client)
+	s.admit(message.Sender(), room)
+	return nil
 }
 
-func (s *Server) RoomWatcher(room *ChatRoom) {
+// rejoining reports whether a client is already in a room with the same
+// keys, such as when it changes its nickname, and so need not prove itself
+// again.
+func (s *Server) rejoining(client *net.UDPAddr, join ConnectRoomMessage) bool {
+	room := s.room(join.Room)
+	if room == nil {
+		return false
+	}
+	room.Lock()
+	defer room.Unlock()
+	member := room.clients[client.String()]
+	return member != nil && member.sharedKey == join.sharedKey && member.identity == join.Identity
+}
+
+// admit adds a client to a room, making the room if it is the first in.
+func (s *Server) admit(client *net.UDPAddr, room ConnectRoomMessage) {
+	token, err := newSessionToken()
+	if err != nil {
+		log.Errorf("No session token for %v: %v", client, err)
+		return
+	}
+	remoteClient := RemoteClient{client, room.sharedKey, room.Name, room.Name, room.Identity, room.Signature, token, [32]byte{}, Uptime{time.Now(), 0}}
+	// The room may empty and be dropped between finding it and adding to
+	// it, in which case it is made again.
 	for {
-		select {
-		case checkMe := <-room.upTimeQueue:
-			if room.clients[checkMe.String()].lastSeen.Before(time.Now().Add(-60*time.Second)) ||
-				room.clients[checkMe.String()].checkCount > 5 {
-				log.Info(checkMe, " disconnected")
-				delete(room.clients, checkMe.String())
-			} else {
-				log.Info("Last seen ", room.clients[checkMe.String()].lastSeen)
-				s.Ping(checkMe)
-				room.clients[checkMe.String()].checkCount += 1
-				go func() {
-					t := time.NewTimer(10 * time.Second)
-					<-t.C
-					room.upTimeQueue <- checkMe
-				}()
-			}
-		case checkMe := <-room.pongQueue:
-			log.Info("Room:", room.clients)
-			if room.clients[checkMe.String()] != nil {
-				room.clients[checkMe.String()].lastSeen = time.Now()
-				room.clients[checkMe.String()].checkCount = 0
-			}
+		s.lock.Lock()
+		chatRoom := s.Rooms[room.Room]
+		if chatRoom == nil {
+			chatRoom = &ChatRoom{name: room.Room, clients: make(map[string]*RemoteClient)}
+			s.restoreHistory(chatRoom)
+			s.Rooms[room.Room] = chatRoom
+		}
+		s.lock.Unlock()
+		if s.AddToRoom(room.Room, chatRoom, &remoteClient) {
+			return
 		}
 	}
 }
 
-func (s *Server) ClientConnectToRoom(message Message) {
-	var room RoomMessage
-	err := room.DecodeMessage(message.RawData())
+// session is the ID handed to a client when it registers, so it gets the
+// same one back if it registers again. seen is when it was last in a room,
+// or registered.
+type session struct {
+	id   uint32
+	seen time.Time
+}
+
+func (s *Server) RegisterClient(message Message) error {
+	client := message.Sender()
+	s.lock.Lock()
+	registered := s.sessions[client.String()]
+	if registered == nil {
+		s.nextSession++
+		registered = &session{id: s.nextSession}
+		s.sessions[client.String()] = registered
+	}
+	registered.seen = time.Now()
+	sessionID := registered.id
+	s.lock.Unlock()
+	log.Infof("Client %v registered with session %d", client, sessionID)
+	response := MiddleManMessage{*client, sessionID, s.Relay}
+	raw, err := response.RawMessage()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Info("Request for room %s\n", room.Room)
-	if s.Rooms[room.Room] == nil {
-		s.Rooms[room.Room] = &ChatRoom{make(map[string]*RemoteClient), make(chan *net.UDPAddr, 10), make(chan *net.UDPAddr, 10)}
-		go s.RoomWatcher(s.Rooms[room.Room])
+	reply := &Message{raw, RESPOND_TO_MIDDLE_MAN, false, uint16(len(raw.Data))}
+	data, err := reply.EncodeMessage()
+	if err != nil {
+		return err
 	}
-	remoteClient := RemoteClient{message.Sender(), *new([32]byte), Uptime{time.Now(), 0}}
-	s.AddToRoom(room.Room, s.Rooms[room.Room], &remoteClient)
+	_, err = s.Conn.WriteToUDP(data, client)
+	return err
 }
 
-func (s *Server) Serve() {
+// pruneSessions forgets clients that have been in no room for Timeout,
+// whether they left, were evicted or never joined one, as happens when the
+// source address was forged. It runs on the timer wheel every ping interval.
+func (s *Server) pruneSessions() {
+	members := make(map[string]bool)
+	for _, room := range s.roomsNow() {
+		for _, address := range room.addresses() {
+			members[address.String()] = true
+		}
+	}
+	now := time.Now()
+	s.lock.Lock()
+	for client, registered := range s.sessions {
+		if members[client] {
+			registered.seen = now
+		} else if now.Sub(registered.seen) > s.Config.Timeout {
+			delete(s.sessions, client)
+		}
+	}
+	s.lock.Unlock()
+	s.wheel.schedule(s.Config.PingInterval, s.pruneSessions)
+}
+
+// Serve answers clients until ctx is cancelled or Close is called, then
+// returns nil once everything has stopped. Bad datagrams are dropped and
+// counted rather than stopping the server.
+func (s *Server) Serve(ctx context.Context) error {
+	err := s.Config.validate()
+	if err != nil {
+		return err
+	}
+	keys, err := NewKeyPair()
+	if err != nil {
+		return err
+	}
+	s.keys = keys
 	addressString := fmt.Sprintf("%v:%v", "", s.Port)
 	ServerAddr, err := net.ResolveUDPAddr("udp", addressString)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	s.Conn, err = net.ListenUDP("udp", ServerAddr)
+	conn, err := net.ListenUDP("udp", ServerAddr)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	growReadBuffer(conn)
+	s.lock.Lock()
+	s.Conn = conn
+	s.lock.Unlock()
+	if s.life.ctx.Err() != nil {
+		conn.Close()
+		return ClosedError
 	}
-	defer s.Conn.Close()
+	defer s.Close()
+	s.wheel.schedule(s.Config.PingInterval, s.pruneRelayBuckets)
+	s.wheel.schedule(s.Config.PingInterval, s.pruneHistory)
+	s.wheel.schedule(s.Config.PingInterval, s.pruneSessions)
+	s.wheel.schedule(fragmentTimeout, s.sweepFragments)
+	s.life.spawn(func() { s.wheel.run(s.life) })
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
 
+	buf := make([]byte, MAX_UDP_DATAGRAM)
 	for {
-		buf := make([]byte, MAX_UDP_DATAGRAM)
 		n, clientAddr, err := s.Conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			log.Warning(err)
+			continue
+		}
 		var message Message
-		message.DecodeMessage(clientAddr, buf[:n])
-		switch message.Type() {
-		case CONNECT_TO_ROOM:
-			s.ClientConnectToRoom(message)
-			break
-		case PONG:
-			for _, room := range s.Rooms {
-				log.Info("Got pong from ", clientAddr)
-				room.pongQueue <- clientAddr
-			}
-			break
+		err = message.DecodeMessage(clientAddr, buf[:n])
+		if versionErr, ok := err.(*VersionError); ok {
+			log.Warningf("%v: %v", clientAddr, versionErr)
+			s.Conn.WriteToUDP(versionMismatch, clientAddr)
+			continue
+		} else if err != nil {
+			s.dropPacket(&message, err)
+			continue
 		}
+		err = s.handleMessage(message)
+		if err != nil {
+			s.dropPacket(&message, err)
+		}
+	}
+}
+
+// Close stops the server and every goroutine it started, and waits for
+// them to finish. Closing twice is harmless.
+func (s *Server) Close() error {
+	return s.life.stop(func() error {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.Conn == nil {
+			return nil
+		}
+		return s.Conn.Close()
+	})
+}
+
+func (s *Server) handleMessage(message Message) error {
+	switch message.Type() {
+	case CONNECT_TO_MIDDLE_MAN:
+		return s.RegisterClient(message)
+	case CONNECT_TO_ROOM:
+		return s.ClientConnectToRoom(message)
+	case DISCONNECT_FROM_ROOM:
+		return s.RemoveFromRoom(message)
+	case HISTORY:
+		return s.StoreHistory(message)
+	case ROOM_HISTORY:
+		return s.SendHistory(message)
+	case VERSION_MISMATCH:
+		version, err := message.MismatchedVersion()
 		if err != nil {
-			fmt.Println("Error: ", err)
+			return err
 		}
+		log.Warningf("%v speaks protocol version %d, we speak %d", message.Sender(), version, PROTOCOL_VERSION)
+		return nil
+	case RELAY_MESSAGE:
+		return s.RelayToPeer(message)
+	case PONG:
+		return s.PongReceived(message)
+	case FRAGMENT:
+		return s.FragmentReceived(message)
+	case ROOM_RESPONSE:
+		return s.RoomResponseReceived(message)
 	}
+	return UnknownMessageError
 }
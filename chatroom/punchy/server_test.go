@@ -0,0 +1,331 @@
+package punchy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	// The server log goes in the working directory. It is set up once for
+	// every server, so it is set up, and quietened, before anything runs:
+	// logging every datagram is slower than handling it, far more so under
+	// the race detector, and changing the level later races with logging.
+	dir, err := os.MkdirTemp("", "punchy")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		panic(err)
+	}
+	err = setUpServerLogging()
+	if err != nil {
+		panic(err)
+	}
+	logging.SetLevel(logging.WARNING, "punchy")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// freePort finds a loopback UDP port nothing is listening on.
+func freePort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startServer runs a server on a free port until the test ends.
+func startServer(t *testing.T, config ServerConfig) *Server {
+	port := freePort(t)
+	s, err := NewServer(&port, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		err := <-served
+		if err != nil && err != ClosedError {
+			t.Error(err)
+		}
+	})
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.lock.Lock()
+		listening := s.Conn != nil
+		s.lock.Unlock()
+		if listening {
+			return &s
+		}
+	}
+	t.Fatal("server never started listening")
+	return nil
+}
+
+// startClient connects a client to the server at port and throws away
+// whatever it has to say until the test ends.
+func startClient(t *testing.T, port int) *Client {
+	c, err := NewClient("127.0.0.1", &port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	display := make(chan DisplayMessage, 64)
+	c.StartUp(display, make(chan ChatMessage))
+	go func() {
+		for {
+			select {
+			case <-display:
+			case <-c.Errors():
+			case <-c.Members():
+			case <-c.History():
+			case <-c.Deliveries():
+			case <-c.Typing():
+			case <-c.Receipts():
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func clientPort(c *Client) int {
+	return c.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// sortedPorts is the set of ports as a sorted list, for comparing.
+func sortedPorts(ports map[int]bool) []int {
+	list := make([]int, 0, len(ports))
+	for port := range ports {
+		list = append(list, port)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// TestServeConcurrentMembership has many clients join and leave rooms at
+// once while the server pings them, then checks that the server and every
+// client agree on who is in each room. In the evicting case some clients
+// go quiet after joining, and the rest keep joining and leaving until the
+// server has timed the quiet ones out.
+func TestServeConcurrentMembership(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  ServerConfig
+		clients int
+		silent  int
+		pause   time.Duration
+	}{
+		{"answering", ServerConfig{PingInterval: 250 * time.Millisecond, Timeout: time.Minute, MaxMissedPings: 1000}, 8, 0, 0},
+		// Every join sends everyone a signed room list to check, which is
+		// slow under the race detector, so joins are paced to leave time
+		// to answer pings before a live member times out.
+		{"evicting", ServerConfig{PingInterval: time.Second, Timeout: 5 * time.Second, MaxMissedPings: 1000}, 6, 2, 500 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			churnMembership(t, tc.config, tc.clients, tc.silent, tc.pause)
+		})
+	}
+}
+
+// churnMembership has clients join and leave rooms, pausing between
+// each, while silent more join every room and go quiet.
+func churnMembership(t *testing.T, config ServerConfig, clients int, silent int, pause time.Duration) {
+	const rounds = 12
+	const maxRounds = 400
+	rooms := []string{"red", "green", "blue"}
+	s := startServer(t, config)
+
+	all := make([]*Client, clients+silent)
+	for i := range all {
+		all[i] = startClient(t, s.Port)
+		// Some nicks clash, so the server has to rename while under load.
+		err := all[i].SetNick(fmt.Sprintf("nick%d", i%4))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The quiet ones join everything, then stop answering pings.
+	quiet := all[clients:]
+	for _, c := range quiet {
+		for _, room := range rooms {
+			err := c.ConnectToRoom(room)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	time.Sleep(config.PingInterval)
+	for _, c := range quiet {
+		c.Close()
+	}
+	quietLeft := func() bool {
+		for _, room := range s.roomsNow() {
+			for _, c := range quiet {
+				if room.member(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: clientPort(c)}) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// joined[i] is the rooms client i is left in once it is done.
+	all = all[:clients]
+	joined := make([]map[string]bool, clients)
+	var wg sync.WaitGroup
+	for i, c := range all {
+		joined[i] = make(map[string]bool)
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			for j := 0; j < maxRounds && (j < rounds || quietLeft()); j++ {
+				room := rooms[(i+j)%len(rooms)]
+				if joined[i][room] && j%3 == 0 {
+					err := c.LeaveRoom(room)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					delete(joined[i], room)
+				} else {
+					err := c.ConnectToRoom(room)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					joined[i][room] = true
+				}
+				// A pong nobody asked for must not count as one.
+				c.Pong(room, [32]byte{})
+				time.Sleep(pause + time.Duration(i%4+1)*time.Millisecond)
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if quietLeft() {
+		t.Fatal("quiet clients never evicted")
+	}
+
+	want := make(map[string]map[int]bool)
+	for _, room := range rooms {
+		want[room] = make(map[int]bool)
+	}
+	for i, c := range all {
+		for room := range joined[i] {
+			want[room][clientPort(c)] = true
+		}
+	}
+
+	var problem string
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		problem = membershipProblem(s, all, joined, want)
+		if problem == "" {
+			break
+		}
+	}
+	if problem != "" {
+		t.Fatal(problem)
+	}
+
+	// Several more rounds of pings, all answered, must not evict anyone.
+	time.Sleep(10 * s.Config.PingInterval)
+	problem = membershipProblem(s, all, joined, want)
+	if problem != "" {
+		t.Fatal("after pinging:", problem)
+	}
+}
+
+// TestRoomListAfterEviction lists a room for someone no longer in it, as
+// happens when they are evicted part way through a broadcast.
+func TestRoomListAfterEviction(t *testing.T) {
+	room := &ChatRoom{name: "r", clients: make(map[string]*RemoteClient)}
+	for port := 1; port <= 2; port++ {
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		room.clients[addr.String()] = &RemoteClient{address: addr, name: fmt.Sprint("m", port)}
+	}
+	list, member := room.list("r", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3})
+	if member || list.Length != 2 || len(list.Names) != 2 {
+		t.Fatal("non-member", member, list.Length, list.Names)
+	}
+	list, member = room.list("r", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if !member || list.Length != 1 || list.Names[0] != "m2" || list.Nick != "m1" {
+		t.Fatal("member", member, list.Length, list.Names, list.Nick)
+	}
+	_, err := list.RawMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// membershipProblem describes how the server or a client disagrees with
+// want, the ports of the clients that should be in each room, or returns "".
+func membershipProblem(s *Server, all []*Client, joined []map[string]bool, want map[string]map[int]bool) string {
+	for roomName, members := range want {
+		room := s.room(roomName)
+		if room == nil {
+			if len(members) > 0 {
+				return fmt.Sprintf("server lost %s", roomName)
+			}
+			continue
+		}
+		room.Lock()
+		got := make(map[int]bool)
+		names := make(map[string]bool)
+		for _, client := range room.clients {
+			got[client.address.Port] = true
+			if names[client.name] {
+				room.Unlock()
+				return fmt.Sprintf("two members of %s are called %s", roomName, client.name)
+			}
+			names[client.name] = true
+		}
+		gone := room.gone
+		room.Unlock()
+		if gone {
+			return fmt.Sprintf("server still lists %s after dropping it", roomName)
+		}
+		if len(members) == 0 {
+			return fmt.Sprintf("server kept %s with nobody in it", roomName)
+		}
+		if fmt.Sprint(sortedPorts(got)) != fmt.Sprint(sortedPorts(members)) {
+			return fmt.Sprintf("server has %v in %s, want %v", sortedPorts(got), roomName, sortedPorts(members))
+		}
+	}
+	for i, c := range all {
+		for roomName := range joined[i] {
+			seen := make(map[int]bool)
+			for _, peer := range c.Peers(roomName) {
+				seen[peer.Port] = true
+			}
+			others := make(map[int]bool)
+			for port := range want[roomName] {
+				if port != clientPort(c) {
+					others[port] = true
+				}
+			}
+			if fmt.Sprint(sortedPorts(seen)) != fmt.Sprint(sortedPorts(others)) {
+				return fmt.Sprintf("client %d sees %v in %s, want %v", i, sortedPorts(seen), roomName, sortedPorts(others))
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,624 @@
+package punchy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FILE_CHUNK_SIZE keeps a sealed chunk inside SAFE_DATAGRAM so transfers
+// never need fragmenting.
+const FILE_CHUNK_SIZE = 1024
+
+// fileWindow is how many chunks the sender sends for each FILE_ACCEPT.
+const fileWindow = 32
+
+const fileStallTimeout = time.Second
+const fileStallRetries = 10
+
+var TransferNotFoundError = errors.New("No such file transfer")
+var FileHashError = errors.New("File does not match the hash it was offered with")
+var BadFileNameError = errors.New("File offered with a name that is not a file name")
+
+// FileOfferMessage offers a peer a file. ID is picked by the sender and
+// names the transfer in every message that follows.
+type FileOfferMessage struct {
+	RoomMessage
+	ID   uint32
+	Name string
+	Size uint64
+	Hash [32]byte
+}
+
+// FileAcceptMessage asks the sender for the file from Offset on. It is sent
+// once to accept, again whenever the receiver wants the next window or has
+// missed something, and finally with Offset equal to the size once the
+// whole file has arrived and matched its hash.
+type FileAcceptMessage struct {
+	ID     uint32
+	Offset uint64
+}
+
+// FileRejectMessage turns down an offer, or calls off a transfer part way.
+type FileRejectMessage struct {
+	ID uint32
+}
+
+type FileChunkMessage struct {
+	ID     uint32
+	Offset uint64
+	Data   []byte
+}
+
+type outgoingFile struct {
+	peer string
+	room string
+	path string
+	name string
+	size uint64
+	hash [32]byte
+}
+
+// incomingFile is an offer we have been sent. Ticket is the number the user
+// accepts or rejects it by, since IDs are only unique per sender.
+type incomingFile struct {
+	ticket   int
+	id       uint32
+	from     net.UDPAddr
+	peer     string
+	room     string
+	name     string
+	size     uint64
+	hash     [32]byte
+	accepted bool
+	offset   uint64
+	window   uint64
+	file     *os.File
+	path     string
+}
+
+type transfers struct {
+	sync.Mutex
+	dir        string
+	nextID     uint32
+	nextTicket int
+	outgoing   map[uint32]*outgoingFile
+	incoming   map[int]*incomingFile
+}
+
+func newTransfers() *transfers {
+	return &transfers{
+		dir:      ".",
+		outgoing: make(map[uint32]*outgoingFile),
+		incoming: make(map[int]*incomingFile),
+	}
+}
+
+func (t *transfers) find(from *net.UDPAddr, id uint32) *incomingFile {
+	for _, incoming := range t.incoming {
+		if incoming.id == id && incoming.from.String() == from.String() {
+			return incoming
+		}
+	}
+	return nil
+}
+
+func (m *FileOfferMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putString(m.Room)
+	w.putUint32(m.ID)
+	w.putString(m.Name)
+	w.putUint64(m.Size)
+	w.putKey(m.Hash)
+	return w.bytes()
+}
+
+func (m *FileOfferMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.Room = r.getString()
+	m.ID = r.getUint32()
+	m.Name = r.getString()
+	m.Size = r.getUint64()
+	m.Hash = r.getKey()
+	return r.done()
+}
+
+func (m *FileAcceptMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.ID)
+	w.putUint64(m.Offset)
+	return w.bytes()
+}
+
+func (m *FileAcceptMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.ID = r.getUint32()
+	m.Offset = r.getUint64()
+	return r.done()
+}
+
+func (m *FileRejectMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.ID)
+	return w.bytes()
+}
+
+func (m *FileRejectMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.ID = r.getUint32()
+	return r.done()
+}
+
+func (m *FileChunkMessage) EncodeMessage() ([]byte, error) {
+	w := new(wireWriter)
+	w.putUint32(m.ID)
+	w.putUint64(m.Offset)
+	w.putBytes(m.Data)
+	return w.bytes()
+}
+
+func (m *FileChunkMessage) DecodeMessage(buf []byte) error {
+	r := &wireReader{buf: buf}
+	m.ID = r.getUint32()
+	m.Offset = r.getUint64()
+	m.Data = r.getBytes()
+	return r.done()
+}
+
+// SetDownloadDir sets where accepted files are saved. It defaults to the
+// working directory.
+func (c *Client) SetDownloadDir(dir string) {
+	c.transfers.Lock()
+	c.transfers.dir = dir
+	c.transfers.Unlock()
+}
+
+func hashFile(path string) ([32]byte, uint64, error) {
+	var hash [32]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return hash, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return hash, 0, err
+	}
+	copy(hash[:], h.Sum(nil))
+	return hash, uint64(n), nil
+}
+
+// sendSealed encrypts a payload with the peer's shared key and sends it.
+func (c *Client) sendSealed(peer *Peer, msgType MessageType, payload []byte) error {
+	if peer.sharedKey == [32]byte{} {
+		return MissingKeyError
+	}
+	sealed, err := Seal(peer.sharedKey, payload)
+	if err != nil {
+		return err
+	}
+	message := &Message{RawMessage{nil, sealed}, msgType, true, uint16(len(sealed))}
+	data, err := message.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	_, err = c.sendToPeer(peer, data)
+	return err
+}
+
+// openSealed finds who sent a message and decrypts it with their key.
+func (c *Client) openSealed(message Message) (*Peer, []byte, error) {
+	if !message.Encrypted() {
+		return nil, nil, DecryptionError
+	}
+	peer := c.findPeer(message.Sender())
+	if peer == nil {
+		return nil, nil, PeerNotFoundError
+	}
+	plaintext, err := Open(peer.sharedKey, message.RawData())
+	return peer, plaintext, err
+}
+
+// OfferFile offers a file to one peer in a room. The transfer starts once
+// they accept it.
+func (c *Client) OfferFile(roomName, peerName, path string) error {
+	var peer *Peer
+	peers := c.Peers(roomName)
+	for i := range peers {
+		if peers[i].Name() == peerName {
+			peer = &peers[i]
+		}
+	}
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	hash, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	c.transfers.Lock()
+	c.transfers.nextID++
+	id := c.transfers.nextID
+	outgoing := &outgoingFile{peer.UDPAddr.String(), roomName, path, filepath.Base(path), size, hash}
+	c.transfers.outgoing[id] = outgoing
+	c.transfers.Unlock()
+
+	offer := FileOfferMessage{RoomMessage{roomName}, id, outgoing.name, size, hash}
+	payload, err := offer.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return c.sendSealed(peer, FILE_OFFER, payload)
+}
+
+// AcceptFile accepts the offer with the given ticket. If an earlier copy
+// of the same file was cut short, it carries on from where that stopped.
+func (c *Client) AcceptFile(ticket int) error {
+	c.transfers.Lock()
+	incoming := c.transfers.incoming[ticket]
+	if incoming == nil || incoming.accepted {
+		c.transfers.Unlock()
+		return TransferNotFoundError
+	}
+	incoming.path = filepath.Join(c.transfers.dir, incoming.name)
+	partPath := fmt.Sprintf("%s.%s.part", incoming.path, hex.EncodeToString(incoming.hash[:4]))
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		c.transfers.Unlock()
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		c.transfers.Unlock()
+		return err
+	}
+	offset := uint64(info.Size()) / FILE_CHUNK_SIZE * FILE_CHUNK_SIZE
+	if offset > incoming.size {
+		offset = 0
+	}
+	incoming.accepted = true
+	incoming.file = file
+	incoming.offset = offset
+	c.transfers.Unlock()
+
+	if offset >= incoming.size {
+		c.life.spawn(func() { c.completeFile(incoming) })
+		return nil
+	}
+	if offset > 0 {
+		c.notify(incoming.room, fmt.Sprintf("Resuming %s from %d bytes", incoming.name, offset))
+	}
+	c.life.spawn(func() { c.watchTransfer(incoming) })
+	return c.requestFile(incoming, offset)
+}
+
+// RejectFile turns down an offer, or stops a transfer that is under way.
+// Whatever has arrived so far is kept so it can be resumed.
+func (c *Client) RejectFile(ticket int) error {
+	c.transfers.Lock()
+	incoming := c.transfers.incoming[ticket]
+	if incoming == nil {
+		c.transfers.Unlock()
+		return TransferNotFoundError
+	}
+	c.closeIncoming(incoming)
+	c.transfers.Unlock()
+
+	peer := c.findPeer(&incoming.from)
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	reject := FileRejectMessage{incoming.id}
+	payload, err := reject.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return c.sendSealed(peer, FILE_REJECT, payload)
+}
+
+// closeIncoming forgets a transfer. The transfers lock must be held.
+func (c *Client) closeIncoming(incoming *incomingFile) {
+	if incoming.file != nil {
+		incoming.file.Close()
+	}
+	delete(c.transfers.incoming, incoming.ticket)
+}
+
+// requestFile asks for the window of chunks starting at offset.
+func (c *Client) requestFile(incoming *incomingFile, offset uint64) error {
+	c.transfers.Lock()
+	incoming.window = offset + FILE_CHUNK_SIZE*fileWindow
+	c.transfers.Unlock()
+	peer := c.findPeer(&incoming.from)
+	if peer == nil {
+		return PeerNotFoundError
+	}
+	accept := FileAcceptMessage{incoming.id, offset}
+	payload, err := accept.EncodeMessage()
+	if err != nil {
+		return err
+	}
+	return c.sendSealed(peer, FILE_ACCEPT, payload)
+}
+
+// watchTransfer asks again if nothing new has arrived for a while, and
+// gives up after fileStallRetries. The partial file is kept so that a new
+// offer of the same file picks up where this one stopped.
+func (c *Client) watchTransfer(incoming *incomingFile) {
+	stalls := 0
+	c.transfers.Lock()
+	last := incoming.offset
+	c.transfers.Unlock()
+	for c.life.sleep(fileStallTimeout) {
+		c.transfers.Lock()
+		if c.transfers.incoming[incoming.ticket] != incoming {
+			c.transfers.Unlock()
+			return
+		}
+		offset := incoming.offset
+		if offset != last {
+			last = offset
+			stalls = 0
+			c.transfers.Unlock()
+			continue
+		}
+		stalls++
+		if stalls > fileStallRetries {
+			c.closeIncoming(incoming)
+			c.transfers.Unlock()
+			c.notify(incoming.room, fmt.Sprintf("Transfer of %s stalled at %d of %d bytes, it will resume if offered again", incoming.name, offset, incoming.size))
+			return
+		}
+		c.transfers.Unlock()
+		log.Warningf("Transfer %d stalled, asking again from %d", incoming.id, offset)
+		err := c.requestFile(incoming, offset)
+		if err != nil {
+			c.reportError(err)
+		}
+	}
+}
+
+func (c *Client) FileOfferReceived(message Message) error {
+	peer, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var offer FileOfferMessage
+	err = offer.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(offer.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return BadFileNameError
+	}
+	c.transfers.Lock()
+	if c.transfers.find(message.Sender(), offer.ID) != nil {
+		c.transfers.Unlock()
+		return nil
+	}
+	c.transfers.nextTicket++
+	ticket := c.transfers.nextTicket
+	c.transfers.incoming[ticket] = &incomingFile{
+		ticket: ticket,
+		id:     offer.ID,
+		from:   *message.Sender(),
+		peer:   peer.Name(),
+		room:   offer.Room,
+		name:   name,
+		size:   offer.Size,
+		hash:   offer.Hash,
+	}
+	c.transfers.Unlock()
+	c.notify(offer.Room, fmt.Sprintf("%s offers %s (%d bytes): /accept %d or /reject %d", peer.Name(), name, offer.Size, ticket, ticket))
+	return nil
+}
+
+func (c *Client) FileAcceptReceived(message Message) error {
+	peer, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var accept FileAcceptMessage
+	err = accept.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	c.transfers.Lock()
+	outgoing := c.transfers.outgoing[accept.ID]
+	if outgoing == nil || outgoing.peer != message.Sender().String() {
+		c.transfers.Unlock()
+		return TransferNotFoundError
+	}
+	if accept.Offset >= outgoing.size {
+		delete(c.transfers.outgoing, accept.ID)
+		c.transfers.Unlock()
+		c.notify(outgoing.room, fmt.Sprintf("Sent %s to %s", outgoing.name, peer.Name()))
+		return nil
+	}
+	c.transfers.Unlock()
+	c.life.spawn(func() { c.sendWindow(peer, accept.ID, outgoing, accept.Offset) })
+	return nil
+}
+
+// sendWindow sends up to fileWindow chunks from offset.
+func (c *Client) sendWindow(peer *Peer, id uint32, outgoing *outgoingFile, offset uint64) {
+	f, err := os.Open(outgoing.path)
+	if err != nil {
+		c.reportError(err)
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, FILE_CHUNK_SIZE)
+	for i := 0; i < fileWindow && offset < outgoing.size; i++ {
+		n, err := f.ReadAt(buf, int64(offset))
+		if n == 0 {
+			c.reportError(err)
+			return
+		}
+		chunk := FileChunkMessage{id, offset, buf[:n]}
+		payload, err := chunk.EncodeMessage()
+		if err == nil {
+			err = c.sendSealed(peer, FILE_CHUNK, payload)
+		}
+		if err != nil {
+			c.reportError(err)
+			return
+		}
+		offset += uint64(n)
+	}
+}
+
+func (c *Client) FileRejectReceived(message Message) error {
+	peer, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var reject FileRejectMessage
+	err = reject.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	c.transfers.Lock()
+	outgoing := c.transfers.outgoing[reject.ID]
+	if outgoing == nil || outgoing.peer != message.Sender().String() {
+		c.transfers.Unlock()
+		return TransferNotFoundError
+	}
+	delete(c.transfers.outgoing, reject.ID)
+	c.transfers.Unlock()
+	c.notify(outgoing.room, fmt.Sprintf("%s turned down %s", peer.Name(), outgoing.name))
+	return nil
+}
+
+// FileChunkReceived writes the next chunk of a transfer. Chunks are only
+// taken in order; anything else is dropped and asked for again when the
+// sender's window runs out.
+func (c *Client) FileChunkReceived(message Message) error {
+	_, plaintext, err := c.openSealed(message)
+	if err != nil {
+		return err
+	}
+	var chunk FileChunkMessage
+	err = chunk.DecodeMessage(plaintext)
+	if err != nil {
+		return err
+	}
+	c.transfers.Lock()
+	incoming := c.transfers.find(message.Sender(), chunk.ID)
+	if incoming == nil || !incoming.accepted || chunk.Offset != incoming.offset || chunk.Offset+uint64(len(chunk.Data)) > incoming.size {
+		c.transfers.Unlock()
+		return nil
+	}
+	_, err = incoming.file.WriteAt(chunk.Data, int64(chunk.Offset))
+	if err != nil {
+		c.closeIncoming(incoming)
+		c.transfers.Unlock()
+		c.notify(incoming.room, fmt.Sprintf("Cannot save %s: %v", incoming.name, err))
+		return nil
+	}
+	incoming.offset += uint64(len(chunk.Data))
+	offset := incoming.offset
+	windowDone := offset >= incoming.window
+	c.transfers.Unlock()
+	if offset >= incoming.size {
+		c.life.spawn(func() { c.completeFile(incoming) })
+	} else if windowDone {
+		return c.requestFile(incoming, offset)
+	}
+	return nil
+}
+
+// completeFile saves a transfer that has all its bytes and tells the
+// sender it is done. Hashing a big file takes a while, so it runs on its
+// own goroutine, with the transfer already out of the table so nothing else
+// touches its file.
+func (c *Client) completeFile(incoming *incomingFile) {
+	c.transfers.Lock()
+	if c.transfers.incoming[incoming.ticket] != incoming {
+		c.transfers.Unlock()
+		return
+	}
+	delete(c.transfers.incoming, incoming.ticket)
+	c.transfers.Unlock()
+	err := finishFile(incoming)
+	if incoming.file != nil {
+		incoming.file.Close()
+	}
+	if err != nil {
+		c.notify(incoming.room, fmt.Sprintf("Cannot save %s from %s: %v", incoming.name, incoming.peer, err))
+		return
+	}
+	err = c.requestFile(incoming, incoming.size)
+	if err != nil {
+		c.reportError(err)
+	}
+	c.notify(incoming.room, fmt.Sprintf("Saved %s from %s to %s", incoming.name, incoming.peer, incoming.path))
+}
+
+// finishFile checks a complete download against its hash and moves it into
+// place, next to rather than over any file already there. A file that does
+// not match is thrown away, since resuming it would not help.
+func finishFile(incoming *incomingFile) error {
+	partPath := incoming.file.Name()
+	err := incoming.file.Truncate(int64(incoming.size))
+	if err != nil {
+		return err
+	}
+	_, err = incoming.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, incoming.file)
+	if err != nil {
+		return err
+	}
+	var hash [32]byte
+	copy(hash[:], h.Sum(nil))
+	incoming.file.Close()
+	incoming.file = nil
+	if hash != incoming.hash {
+		os.Remove(partPath)
+		return FileHashError
+	}
+	path, err := claimPath(incoming.path)
+	if err != nil {
+		return err
+	}
+	incoming.path = path
+	return os.Rename(partPath, path)
+}
+
+// claimPath finds a name for a download that is not taken yet, trying
+// "name (1).ext", "name (2).ext" and so on after the name itself. It creates
+// an empty file there so that two downloads cannot pick the same one.
+func claimPath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; ; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		f, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return candidate, f.Close()
+	}
+}
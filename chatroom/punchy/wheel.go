@@ -0,0 +1,79 @@
+package punchy
+
+import (
+	"sync"
+	"time"
+)
+
+// wheelTick is how finely the timer wheel keeps time. Anything scheduled
+// sooner than one tick away fires on the next tick.
+const wheelTick = 100 * time.Millisecond
+
+// wheelSlots is how many ticks one turn of the wheel takes.
+const wheelSlots = 512
+
+// timerWheel runs every keepalive check for a server from one goroutine,
+// however many clients there are. A timer is filed in the slot for the tick
+// it is due on, with the number of whole turns still to wait when it is
+// further away than one turn.
+type timerWheel struct {
+	sync.Mutex
+	slots   [wheelSlots][]wheelTimer
+	current int
+}
+
+type wheelTimer struct {
+	rounds int
+	fire   func()
+}
+
+func newTimerWheel() *timerWheel {
+	return &timerWheel{}
+}
+
+// schedule calls fire from the wheel's goroutine once delay has passed.
+func (w *timerWheel) schedule(delay time.Duration, fire func()) {
+	ticks := int(delay / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	w.Lock()
+	defer w.Unlock()
+	slot := (w.current + ticks) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], wheelTimer{(ticks - 1) / wheelSlots, fire})
+}
+
+// run turns the wheel until life is stopped.
+func (w *timerWheel) run(life *lifecycle) {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-life.done():
+			return
+		case <-ticker.C:
+		}
+		for _, timer := range w.advance() {
+			timer.fire()
+		}
+	}
+}
+
+// advance moves on a tick and returns the timers that are now due.
+func (w *timerWheel) advance() []wheelTimer {
+	w.Lock()
+	defer w.Unlock()
+	w.current = (w.current + 1) % wheelSlots
+	due := make([]wheelTimer, 0)
+	waiting := w.slots[w.current][:0]
+	for _, timer := range w.slots[w.current] {
+		if timer.rounds > 0 {
+			timer.rounds--
+			waiting = append(waiting, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	w.slots[w.current] = waiting
+	return due
+}
@@ -0,0 +1,262 @@
+package punchy
+
+/*
+Wire format
+
+Every datagram starts with the same seven byte header, in every version of
+the protocol:
+
+	offset  size  field
+	0       2     magic, "LY" (0x4c 0x59)
+	2       1     protocol version, PROTOCOL_VERSION
+	3       1     message type
+	4       1     flags, bit 0 is set if the payload is encrypted
+	5       2     payload length
+	7       n     payload
+
+Payloads are a sequence of fields with no padding:
+
+	uint8, uint16, uint32, uint64   big endian
+	bool                            one byte, 0 or 1
+	string, bytes                   uint16 length, then that many bytes
+	address                         uint8 IP length (4 or 16), the IP, uint16 port
+	key                             32 bytes
+	signature                       64 bytes
+	list                            uint16 count, then each element
+
+A datagram is rejected if the magic is wrong, the payload length does not
+match what arrived, a field runs off the end, or bytes are left over. A
+datagram from a different protocol version is rejected too, except for
+VERSION_MISMATCH, whose payload is a single uint8 giving the sender's version.
+Whoever receives a datagram from another version answers with one, so both
+ends find out they cannot talk rather than silently dropping each other.
+
+A datagram longer than SAFE_DATAGRAM is sent as FRAGMENT messages instead,
+each carrying a uint32 ID, uint16 index, uint16 count and a slice of the
+encoded datagram. The receiver joins the slices back together and decodes
+the result as if it had arrived whole. A message sent this way, such as a
+big room's ROOM_LIST, may be up to MAX_FRAGMENTED_MESSAGE bytes, more than
+one datagram holds; if its payload is too long for the length field, the
+field is zero.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const PROTOCOL_VERSION = 8
+
+const HEADER_SIZE = 7
+
+var protocolMagic = [2]byte{'L', 'Y'}
+
+const flagEncrypted = 1
+
+var MessageTooLargeError = errors.New("Message is larger than a datagram")
+
+// VersionError is returned when decoding a datagram from a peer speaking a
+// different version of the protocol.
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Peer speaks protocol version %d, we speak %d", e.Version, PROTOCOL_VERSION)
+}
+
+type wireWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *wireWriter) putUint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *wireWriter) putUint16(v uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+}
+
+func (w *wireWriter) putUint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *wireWriter) putUint64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *wireWriter) putBool(v bool) {
+	if v {
+		w.putUint8(1)
+	} else {
+		w.putUint8(0)
+	}
+}
+
+func (w *wireWriter) putLength(n int) {
+	if n > 0xffff {
+		w.err = ProtocolWriteError
+		return
+	}
+	w.putUint16(uint16(n))
+}
+
+func (w *wireWriter) putBytes(v []byte) {
+	w.putLength(len(v))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) putString(v string) {
+	w.putLength(len(v))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) putKey(v [32]byte) {
+	w.buf = append(w.buf, v[:]...)
+}
+
+func (w *wireWriter) putSignature(v [64]byte) {
+	w.buf = append(w.buf, v[:]...)
+}
+
+func (w *wireWriter) putAddress(v *net.UDPAddr) {
+	ip := v.IP.To4()
+	if ip == nil {
+		ip = v.IP.To16()
+	}
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	w.putUint8(uint8(len(ip)))
+	w.buf = append(w.buf, ip...)
+	if v.Port < 0 || v.Port > 0xffff {
+		w.err = ProtocolWriteError
+		return
+	}
+	w.putUint16(uint16(v.Port))
+}
+
+func (w *wireWriter) bytes() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// wireReader reads fields off a payload. The first field that does not fit
+// sets err, and every read after that returns zero values.
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = ProtocolReadError
+		return nil
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *wireReader) getUint8() uint8 {
+	v := r.take(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (r *wireReader) getUint16() uint16 {
+	v := r.take(2)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v)
+}
+
+func (r *wireReader) getUint32() uint32 {
+	v := r.take(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (r *wireReader) getUint64() uint64 {
+	v := r.take(8)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (r *wireReader) getBool() bool {
+	v := r.getUint8()
+	if v > 1 {
+		r.err = ProtocolReadError
+	}
+	return v == 1
+}
+
+func (r *wireReader) getBytes() []byte {
+	v := r.take(int(r.getUint16()))
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (r *wireReader) getString() string {
+	return string(r.take(int(r.getUint16())))
+}
+
+func (r *wireReader) getKey() [32]byte {
+	var key [32]byte
+	copy(key[:], r.take(32))
+	return key
+}
+
+func (r *wireReader) getSignature() [64]byte {
+	var signature [64]byte
+	copy(signature[:], r.take(64))
+	return signature
+}
+
+func (r *wireReader) getAddress() net.UDPAddr {
+	var addr net.UDPAddr
+	size := int(r.getUint8())
+	if size != net.IPv4len && size != net.IPv6len {
+		r.err = ProtocolReadError
+		return addr
+	}
+	addr.IP = append(net.IP(nil), r.take(size)...)
+	addr.Port = int(r.getUint16())
+	return addr
+}
+
+// getCount reads a list length, rejecting it early if the rest of the
+// payload could not possibly hold that many elements of at least minSize.
+func (r *wireReader) getCount(minSize int) int {
+	n := int(r.getUint16())
+	if n*minSize > len(r.buf) {
+		r.err = ProtocolReadError
+		return 0
+	}
+	return n
+}
+
+// done checks the whole payload was used.
+func (r *wireReader) done() error {
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = ProtocolReadError
+	}
+	return r.err
+}
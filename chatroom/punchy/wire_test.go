@@ -0,0 +1,154 @@
+package punchy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// payload is any message body with its own wire encoding.
+type payload interface {
+	EncodeMessage() ([]byte, error)
+	DecodeMessage([]byte) error
+}
+
+// TestPayloadRoundTrip encodes each payload, checks it decodes back to the
+// same thing, and that the encoding cut short or with a byte left over is
+// rejected.
+func TestPayloadRoundTrip(t *testing.T) {
+	ipv4 := net.IP{192, 0, 2, 1}
+	ipv6 := net.ParseIP("2001:db8::1")
+	cases := []struct {
+		name  string
+		in    payload
+		empty func() payload
+	}{
+		{"room", &RoomMessage{"Hello"}, func() payload { return new(RoomMessage) }},
+		{"chat", &ChatMessage{RoomMessage{"Hello"}, "hi there", "alice", 7}, func() payload { return new(ChatMessage) }},
+		{"relay", &RelayMessage{net.UDPAddr{IP: ipv6, Port: 9000}, []byte{1, 2, 3}}, func() payload { return new(RelayMessage) }},
+		{"middle man", &MiddleManMessage{net.UDPAddr{IP: ipv4, Port: 1}, 42, true}, func() payload { return new(MiddleManMessage) }},
+		{"room list", &RoomListMessage{
+			RoomMessage{"Hello"}, 2,
+			[]net.UDPAddr{{IP: ipv4, Port: 5}, {IP: ipv6, Port: 6}},
+			[][32]byte{{1}, {2}},
+			[]string{"alice", "bob_2"},
+			[]string{"alice", "bob"},
+			[][32]byte{{3}, {4}},
+			[][64]byte{{5}, {6}},
+			"carol",
+			[32]byte{7},
+		}, func() payload { return new(RoomListMessage) }},
+		{"history", &HistoryMessage{RoomMessage{"Hello"}, []HistoryEntry{
+			{net.UDPAddr{IP: ipv4, Port: 5}, "alice", false, []byte("plain")},
+			{net.UDPAddr{IP: ipv6, Port: 6}, "bob", true, []byte("sealed")},
+		}}, func() payload { return new(HistoryMessage) }},
+		{"presence", &PresenceMessage{RoomMessage{"Hello"}, PresenceEvent(1), net.UDPAddr{IP: ipv4, Port: 5}, "alice"}, func() payload { return new(PresenceMessage) }},
+		{"pong", &PongMessage{RoomMessage{"Hello"}, [32]byte{1}, [32]byte{2}}, func() payload { return new(PongMessage) }},
+		{"fragment", &FragmentMessage{3, 1, 4, []byte{9, 9}}, func() payload { return new(FragmentMessage) }},
+		{"reliable", &ReliableMessage{5, 10, 8, []byte{1}}, func() payload { return new(ReliableMessage) }},
+		{"ack", &AckMessage{5, 10}, func() payload { return new(AckMessage) }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := tc.in.EncodeMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := tc.empty()
+			err = out.DecodeMessage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, tc.in) {
+				t.Fatalf("decoded %+v, want %+v", out, tc.in)
+			}
+			for n := 0; n < len(data); n++ {
+				if tc.empty().DecodeMessage(data[:n]) == nil {
+					t.Fatalf("decoded the first %d of %d bytes", n, len(data))
+				}
+			}
+			if tc.empty().DecodeMessage(append(data, 0)) == nil {
+				t.Fatal("decoded with a trailing byte")
+			}
+		})
+	}
+}
+
+// TestPayloadCounts checks a list claiming more elements than the rest of
+// the payload could hold is rejected before anything is made for them.
+func TestPayloadCounts(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  []byte
+		empty payload
+	}{
+		// Room "r", then the count.
+		{"history", []byte{0, 1, 'r', 0xff, 0xff}, new(HistoryMessage)},
+		{"room list", []byte{0, 1, 'r', 0xff, 0xff}, new(RoomListMessage)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !errors.Is(tc.empty.DecodeMessage(tc.data), ProtocolReadError) {
+				t.Fatal("decoded a count of 65535 from", tc.data)
+			}
+		})
+	}
+}
+
+// TestMessageHeader decodes datagrams with good and bad headers.
+func TestMessageHeader(t *testing.T) {
+	good := []byte{'L', 'Y', PROTOCOL_VERSION, uint8(ROOM_MESSAGE), flagEncrypted, 0, 2, 'h', 'i'}
+	with := func(i int, b byte) []byte {
+		data := append([]byte(nil), good...)
+		data[i] = b
+		return data
+	}
+	cases := []struct {
+		name    string
+		data    []byte
+		err     error
+		version bool
+	}{
+		{"good", good, nil, false},
+		{"empty", nil, ProtocolReadError, false},
+		{"short header", good[:HEADER_SIZE-1], ProtocolReadError, false},
+		{"wrong magic", with(0, 'X'), ProtocolReadError, false},
+		{"other version", with(2, PROTOCOL_VERSION+1), nil, true},
+		{"truncated payload", good[:len(good)-1], ProtocolReadError, false},
+		{"trailing bytes", append(append([]byte(nil), good...), 0), ProtocolReadError, false},
+		{"length too long", with(6, 0xff), ProtocolReadError, false},
+		{"version mismatch from another version", []byte{'L', 'Y', PROTOCOL_VERSION + 1, uint8(VERSION_MISMATCH), 0, 0, 1, PROTOCOL_VERSION + 1}, nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var message Message
+			err := message.DecodeMessage(nil, tc.data)
+			if tc.version {
+				versionErr, ok := err.(*VersionError)
+				if !ok || versionErr.Version != PROTOCOL_VERSION+1 {
+					t.Fatalf("got %v, want a version error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	var message Message
+	err := message.DecodeMessage(nil, good)
+	if err != nil || message.Type() != ROOM_MESSAGE || !message.Encrypted() || string(message.Data) != "hi" {
+		t.Fatal(err, message)
+	}
+	data, err := message.EncodeMessage()
+	if err != nil || !reflect.DeepEqual(data, good) {
+		t.Fatal(err, data)
+	}
+	big := Message{RawMessage{nil, make([]byte, MAX_UDP_DATAGRAM)}, ROOM_MESSAGE, false, 0}
+	_, err = big.EncodeMessage()
+	if err != MessageTooLargeError {
+		t.Fatal(err)
+	}
+}
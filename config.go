@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/MerreM/lemony/chatroom/punchy"
+)
+
+// Config is what ~/.config/lemony/config.toml can hold. Anything left out
+// keeps its default, and flags given on the command line win over the file.
+//
+//	server = "chat.example.com:9000"
+//	nick = "alice"
+//	rooms = ["Hello", "ops"]
+//	reliable = true
+//	history = true
+//	history_key = "a passphrase"
+//	download_dir = "~/Downloads"
+//	heartbeat = "10s"
+//
+//	[passwords]
+//	ops = "the ops room password"
+//
+//	[keys]
+//	x25519 = "~/.config/lemony/x25519.key"
+//	ed25519 = "~/.config/lemony/ed25519.key"
+//	known_peers = "~/.config/lemony/known_peers"
+//
+//	[ui]
+//	console = false
+//	highlight = "green"
+type Config struct {
+	Server      string            `toml:"server"`
+	Nick        string            `toml:"nick"`
+	Rooms       []string          `toml:"rooms"`
+	Reliable    bool              `toml:"reliable"`
+	History     bool              `toml:"history"`
+	HistoryKey  string            `toml:"history_key"`
+	DownloadDir string            `toml:"download_dir"`
+	Heartbeat   string            `toml:"heartbeat"`
+	Passwords   map[string]string `toml:"passwords"`
+	Keys        KeysConfig        `toml:"keys"`
+	UI          UIConfig          `toml:"ui"`
+}
+
+// KeysConfig says where our keys live. A key file that does not exist yet
+// is created, so we keep the same identity from one run to the next.
+// KnownPeers is where the identity keys of peers we have met are kept.
+type KeysConfig struct {
+	X25519     string `toml:"x25519"`
+	Ed25519    string `toml:"ed25519"`
+	KnownPeers string `toml:"known_peers"`
+}
+
+type UIConfig struct {
+	Console   bool   `toml:"console"`
+	Highlight string `toml:"highlight"`
+}
+
+const DEFAULT_ROOM = "Hello"
+
+func configDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".lemony"
+	}
+	return filepath.Join(home, ".config", "lemony")
+}
+
+func defaultConfig() Config {
+	return Config{
+		Rooms: []string{DEFAULT_ROOM},
+		Keys: KeysConfig{
+			X25519:     filepath.Join(configDir(), "x25519.key"),
+			Ed25519:    filepath.Join(configDir(), "ed25519.key"),
+			KnownPeers: filepath.Join(configDir(), "known_peers"),
+		},
+		UI: UIConfig{Highlight: "green"},
+	}
+}
+
+// loadConfig reads a config file over the defaults. A missing file is not
+// an error, there is just nothing to read.
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+	_, err := toml.DecodeFile(path, &config)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	config.Keys.X25519 = expandHome(config.Keys.X25519)
+	config.Keys.Ed25519 = expandHome(config.Keys.Ed25519)
+	config.Keys.KnownPeers = expandHome(config.Keys.KnownPeers)
+	config.DownloadDir = expandHome(config.DownloadDir)
+	return config, nil
+}
+
+// expandHome turns a leading ~ into the home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// roomAccess is one room in the server's -rooms file:
+//
+//	[ops]
+//	password = "the ops room password"
+//
+//	[staff]
+//	allow = ["<base64 public key>", "<base64 public key>"]
+//
+// Members find their public key with /key.
+type roomAccess struct {
+	Password string   `toml:"password"`
+	Allow    []string `toml:"allow"`
+}
+
+func loadRoomAccess(path string) (map[string]punchy.RoomAccess, error) {
+	rooms := make(map[string]roomAccess)
+	_, err := toml.DecodeFile(path, &rooms)
+	if err != nil {
+		return nil, err
+	}
+	access := make(map[string]punchy.RoomAccess)
+	for name, room := range rooms {
+		allow := make([][32]byte, len(room.Allow))
+		for i, encoded := range room.Allow {
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("Room %s: %q is not a base64 public key", name, encoded)
+			}
+			copy(allow[i][:], key)
+		}
+		access[name] = punchy.RoomAccess{Password: room.Password, Allow: allow}
+	}
+	return access, nil
+}
+
+// roomFlags collects every -room given on the command line.
+type roomFlags []string
+
+func (r *roomFlags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *roomFlags) Set(room string) error {
+	*r = append(*r, room)
+	return nil
+}
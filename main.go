@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
-
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/MerreM/lemony/chatroom/punchy"
 	"github.com/MerreM/lemony/ui"
@@ -46,16 +52,151 @@ func initLogging() {
 func main() {
 
 	serverPort := flag.Int("s", 0, "Listen mode. Specify port")
-	clientConnect := flag.Int("c", 0, "Send mode. Specify port")
+	clientConnect := flag.Int("c", 0, "Send mode. Connect to a server on localhost at this port")
+	relay := flag.Bool("relay", false, "Listen mode. Relay messages between peers that cannot punch through")
+	relayLimit := flag.Int("relay-limit", punchy.DEFAULT_RELAY_LIMIT, "Listen mode. Bytes per second each client may relay")
+	roomsPath := flag.String("rooms", "", "Listen mode. TOML file of room passwords and allow-lists")
+	keepalive := punchy.DefaultServerConfig()
+	pingInterval := flag.Duration("ping-interval", keepalive.PingInterval, "Listen mode. How often to ping each member of a room")
+	timeout := flag.Duration("timeout", keepalive.Timeout, "Listen mode. Evict members who have not answered a ping for this long")
+	maxMissed := flag.Int("max-missed", keepalive.MaxMissedPings, "Listen mode. Evict members who miss this many pings in a row")
+	configPath := flag.String("config", filepath.Join(configDir(), "config.toml"), "Send mode. Config file")
+	serverAddress := flag.String("server", "", "Send mode. Server to connect to, as host:port")
+	nick := flag.String("nick", "", "Send mode. Nickname to use in every room")
+	var rooms roomFlags
+	flag.Var(&rooms, "room", "Send mode. Room to join, may be given more than once")
+	history := flag.Bool("history", false, "Send mode. Let the server keep a copy of what you say")
+	historyKey := flag.String("history-key", "", "Send mode. Passphrase to encrypt history copies with")
+	reliable := flag.Bool("reliable", false, "Send mode. Acknowledge and resend chat messages so they arrive in order")
+	heartbeat := flag.Duration("heartbeat", punchy.DEFAULT_HEARTBEAT, "Send mode. How often to check in with each peer, 0 to stop")
 	flag.Parse()
 	if serverPort != nil && *serverPort != 0 {
-		server := punchy.NewServer(serverPort)
-		server.Serve()
+		keepalive = punchy.ServerConfig{PingInterval: *pingInterval, Timeout: *timeout, MaxMissedPings: *maxMissed}
+		server, err := punchy.NewServer(serverPort, keepalive)
+		if err != nil {
+			log.Criticalf("Starting server: %v", err)
+			os.Exit(1)
+		}
+		server.Relay = *relay
+		server.RelayLimit = *relayLimit
+		if *roomsPath != "" {
+			access, err := loadRoomAccess(*roomsPath)
+			if err != nil {
+				log.Criticalf("Reading %s: %v", *roomsPath, err)
+				os.Exit(1)
+			}
+			server.Access = access
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = server.Serve(ctx)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
 		return
-	} else if clientConnect != nil && *clientConnect != 0 {
-		client := punchy.NewClient("localhost", clientConnect)
-		ui.InitUi(client)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Criticalf("Reading %s: %v", *configPath, err)
+		os.Exit(1)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "c":
+			config.Server = fmt.Sprintf("localhost:%d", *clientConnect)
+		case "server":
+			config.Server = *serverAddress
+		case "nick":
+			config.Nick = *nick
+		case "room":
+			config.Rooms = rooms
+		case "history":
+			config.History = *history
+		case "history-key":
+			config.HistoryKey = *historyKey
+		case "reliable":
+			config.Reliable = *reliable
+		case "heartbeat":
+			config.Heartbeat = heartbeat.String()
+		}
+	})
+	if config.Server == "" {
+		flag.Usage()
 		return
 	}
-	flag.Usage()
+	client, err := newClient(config)
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+	ui.InitUi(client, ui.Preferences{Console: config.UI.Console, Highlight: config.UI.Highlight}, config.Rooms...)
+	client.Close()
+}
+
+// newClient sets up a client as the config asks, ready for the UI.
+func newClient(config Config) (*punchy.Client, error) {
+	host, portString, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	client, err := punchy.NewClient(host, &port)
+	if err != nil {
+		return nil, err
+	}
+	if config.Keys.X25519 != "" {
+		keys, err := punchy.LoadKeyPair(config.Keys.X25519)
+		if err != nil {
+			return nil, err
+		}
+		client.SetKeyPair(keys)
+	}
+	if config.Keys.Ed25519 != "" {
+		identity, err := punchy.LoadIdentity(config.Keys.Ed25519)
+		if err != nil {
+			return nil, err
+		}
+		client.SetIdentity(identity)
+	}
+	if config.Keys.KnownPeers != "" {
+		known, err := punchy.LoadKnownPeers(config.Keys.KnownPeers)
+		if err != nil {
+			return nil, err
+		}
+		client.SetKnownPeers(known)
+	}
+	if config.Nick != "" {
+		err = client.SetNick(config.Nick)
+		if err != nil {
+			return nil, fmt.Errorf("Nick %q: %v", config.Nick, err)
+		}
+	}
+	for room, password := range config.Passwords {
+		client.SetRoomPassword(room, password)
+	}
+	if config.DownloadDir != "" {
+		client.SetDownloadDir(config.DownloadDir)
+	}
+	if config.History {
+		client.EnableHistory()
+	}
+	if config.HistoryKey != "" {
+		client.SetHistoryKey(punchy.HistoryKey(config.HistoryKey))
+	}
+	if config.Reliable {
+		client.EnableReliable()
+	}
+	if config.Heartbeat != "" {
+		interval, err := time.ParseDuration(config.Heartbeat)
+		if err != nil {
+			return nil, fmt.Errorf("Heartbeat %q: %v", config.Heartbeat, err)
+		}
+		client.SetHeartbeat(interval)
+	}
+	return client, nil
 }
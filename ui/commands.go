@@ -0,0 +1,299 @@
+package ui
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MerreM/lemony/chatroom/punchy"
+	"github.com/jroimartin/gocui"
+)
+
+var UnknownCommandError = errors.New("Unknown command, try /help")
+var NotInRoomError = errors.New("You are not in a room, try /join <room>")
+
+// command is a slash command typed into the input box. Run is called from
+// the UI goroutine with the words that followed the command name.
+type command struct {
+	name  string
+	usage string
+	help  string
+	args  int
+	run   func(manager *ChatboxManager, g *gocui.Gui, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func registerCommand(c *command) {
+	commands[c.name] = c
+}
+
+func init() {
+	registerCommand(&command{"join", "/join <room> [password]", "Join a room and switch to it", 1, cmdJoin})
+	registerCommand(&command{"leave", "/leave", "Leave the current room", 0, cmdLeave})
+	registerCommand(&command{"nick", "/nick <name>", "Change your nickname", 1, cmdNick})
+	registerCommand(&command{"who", "/who", "List the peers in the current room", 0, cmdWho})
+	registerCommand(&command{"whois", "/whois [peer]", "Show a peer's identity fingerprint, or your own", 0, cmdWhois})
+	registerCommand(&command{"trust", "/trust <peer>", "Accept a peer's new identity key once you have checked it", 1, cmdTrust})
+	registerCommand(&command{"msg", "/msg <peer> <text>", "Send a private message to one peer", 2, cmdMsg})
+	registerCommand(&command{"me", "/me <action>", "Tell the room what you are doing", 1, cmdMe})
+	registerCommand(&command{"send", "/send <peer> <path>", "Offer a file to one peer in the current room", 2, cmdSend})
+	registerCommand(&command{"accept", "/accept <number>", "Accept a file you have been offered", 1, cmdAccept})
+	registerCommand(&command{"reject", "/reject <number>", "Turn down a file offer or stop a transfer", 1, cmdReject})
+	registerCommand(&command{"key", "/key", "Show your public key, for a room's allow-list", 0, cmdKey})
+	registerCommand(&command{"clear", "/clear", "Clear the current room", 0, cmdClear})
+	registerCommand(&command{"quit", "/quit", "Leave every room and exit", 0, cmdQuit})
+	registerCommand(&command{"help", "/help", "List commands", 0, cmdHelp})
+}
+
+// runCommand parses a line starting with "/" and runs it. Errors from
+// parsing or from the command are shown in the chat box rather than dropped.
+func (manager *ChatboxManager) runCommand(g *gocui.Gui, line string) error {
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		manager.systemLine(g, UnknownCommandError.Error())
+		return nil
+	}
+	c := commands[fields[0]]
+	if c == nil {
+		manager.systemLine(g, fmt.Sprintf("/%s: %v", fields[0], UnknownCommandError))
+		return nil
+	}
+	args := fields[1:]
+	if len(args) < c.args {
+		manager.systemLine(g, "Usage: "+c.usage)
+		return nil
+	}
+	err := c.run(manager, g, args)
+	if err == gocui.ErrQuit {
+		return err
+	}
+	if err != nil {
+		manager.systemLine(g, fmt.Sprintf("/%s: %v", c.name, err))
+	}
+	return nil
+}
+
+// completeCommand finishes the command name being typed, or lists the
+// candidates if there is more than one. It reports whether there was a
+// command name to complete.
+func (manager *ChatboxManager) completeCommand(g *gocui.Gui, v *gocui.View) bool {
+	typed := strings.TrimSuffix(v.Buffer(), "\n")
+	if !strings.HasPrefix(typed, "/") || strings.Contains(typed, " ") {
+		return false
+	}
+	prefix := strings.TrimPrefix(typed, "/")
+	matches := make([]string, 0)
+	for name := range commands {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	if len(matches) == 0 {
+		return true
+	}
+	completed := matches[0]
+	if len(matches) == 1 {
+		completed += " "
+	} else {
+		for _, match := range matches[1:] {
+			for !strings.HasPrefix(match, completed) {
+				completed = completed[:len(completed)-1]
+			}
+		}
+		manager.systemLine(g, "/"+strings.Join(matches, " /"))
+	}
+	v.Clear()
+	v.SetOrigin(0, 0)
+	fmt.Fprint(v, "/"+completed)
+	v.SetCursor(len(completed)+1, 0)
+	return true
+}
+
+func cmdJoin(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if len(args) > 1 {
+		manager.chatroomClient.SetRoomPassword(args[0], args[1])
+	}
+	manager.joinRoom(g, args[0])
+	return nil
+}
+
+func cmdKey(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	key := manager.chatroomClient.PublicKey()
+	manager.systemLine(g, "Your public key is "+base64.StdEncoding.EncodeToString(key[:]))
+	return nil
+}
+
+func cmdLeave(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if manager.room == "" {
+		return NotInRoomError
+	}
+	manager.leaveRoom(g)
+	return nil
+}
+
+func cmdNick(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	err := manager.chatroomClient.SetNick(args[0])
+	if err != nil {
+		return err
+	}
+	manager.systemLine(g, "You are now known as "+args[0])
+	return nil
+}
+
+func cmdWho(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if _, direct := directPeer(manager.room); manager.room == "" || direct {
+		return NotInRoomError
+	}
+	peers := manager.chatroomClient.Peers(manager.room)
+	if len(peers) == 0 {
+		manager.systemLine(g, "Nobody else is in "+manager.room)
+		return nil
+	}
+	for _, peer := range peers {
+		manager.systemLine(g, fmt.Sprintf("%s %v (%s)", peer.Name(), peer.Address(), peerStatus(peer)))
+	}
+	return nil
+}
+
+// latency is the round trip time to a peer for showing, or "" if we have
+// not timed one yet.
+func latency(peer punchy.Peer) string {
+	rtt := peer.RTT()
+	if rtt == 0 {
+		return ""
+	} else if rtt < time.Millisecond {
+		return "<1ms"
+	}
+	return fmt.Sprintf("%dms", rtt.Milliseconds())
+}
+
+// peerStatus is how we reach a peer, and how quickly if we reach them
+// directly.
+func peerStatus(peer punchy.Peer) string {
+	if rtt := latency(peer); rtt != "" && peer.State() == punchy.PeerConnected {
+		return fmt.Sprintf("%v, %s", peer.State(), rtt)
+	}
+	return peer.State().String()
+}
+
+// findPeer looks for a peer by name in the current room, or in every room
+// when we are not in one or are talking to someone privately.
+func (manager *ChatboxManager) findPeer(name string) (punchy.Peer, bool) {
+	rooms := []string{manager.room}
+	if _, direct := directPeer(manager.room); manager.room == "" || direct {
+		rooms = manager.chatroomClient.Rooms()
+	}
+	for _, roomName := range rooms {
+		for _, peer := range manager.chatroomClient.Peers(roomName) {
+			if peer.Name() == name {
+				return peer, true
+			}
+		}
+	}
+	return punchy.Peer{}, false
+}
+
+func cmdWhois(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if len(args) == 0 {
+		manager.systemLine(g, "Your fingerprint is "+manager.chatroomClient.Fingerprint())
+		return nil
+	}
+	peer, ok := manager.findPeer(args[0])
+	if !ok {
+		return punchy.PeerNotFoundError
+	}
+	manager.systemLine(g, fmt.Sprintf("%s %v (%s)", peer.Name(), peer.Address(), peerStatus(peer)))
+	manager.systemLine(g, fmt.Sprintf("Fingerprint %s (%v)", peer.Fingerprint(), peer.Trust()))
+	return nil
+}
+
+func cmdTrust(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	err := manager.chatroomClient.Trust(args[0])
+	if err != nil {
+		return err
+	}
+	manager.systemLine(g, "Trusting "+args[0]+"'s identity key from now on")
+	return nil
+}
+
+// cmdMsg opens a private conversation with a peer and sends the first line.
+func cmdMsg(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	err := manager.sendPrivate(g, args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	manager.room = punchy.DirectRoom(args[0])
+	manager.redraw(g)
+	return nil
+}
+
+func cmdMe(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if manager.room == "" {
+		return NotInRoomError
+	}
+	manager.sendToRoom(g, "/me "+strings.Join(args, " "))
+	return nil
+}
+
+func cmdSend(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	if _, direct := directPeer(manager.room); manager.room == "" || direct {
+		return NotInRoomError
+	}
+	path := strings.Join(args[1:], " ")
+	err := manager.chatroomClient.OfferFile(manager.room, args[0], path)
+	if err != nil {
+		return err
+	}
+	manager.systemLine(g, fmt.Sprintf("Offered %s to %s", path, args[0]))
+	return nil
+}
+
+func cmdAccept(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	ticket, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	return manager.chatroomClient.AcceptFile(ticket)
+}
+
+func cmdReject(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	ticket, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	return manager.chatroomClient.RejectFile(ticket)
+}
+
+func cmdClear(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	tab := manager.rooms[manager.room]
+	if tab == nil {
+		return NotInRoomError
+	}
+	tab.history = nil
+	tab.lines = nil
+	tab.sent = nil
+	manager.drawChat(g)
+	return nil
+}
+
+func cmdQuit(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	return manager.quit(g, nil)
+}
+
+func cmdHelp(manager *ChatboxManager, g *gocui.Gui, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		manager.systemLine(g, fmt.Sprintf("%-20s %s", commands[name].usage, commands[name].help))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package ui
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MerreM/lemony/chatroom/punchy"
+	"github.com/jroimartin/gocui"
+)
+
+// memberWidth is how wide the member list beside the chat box is.
+const memberWidth = 30
+
+// memberRefresh is how often the member list is redrawn to keep idle
+// times current, when nothing else has changed.
+const memberRefresh = time.Second
+
+// sidebarWidth is the width left for the member list, which gives way to
+// the chat box on narrow terminals.
+func sidebarWidth(g *gocui.Gui) int {
+	maxX, _ := g.Size()
+	if maxX < memberWidth*3 {
+		return maxX / 3
+	}
+	return memberWidth
+}
+
+func (manager *ChatboxManager) memberListLayout(g *gocui.Gui) error {
+	maxX, maxY := g.Size()
+	if v, err := g.SetView("member-list", maxX-sidebarWidth(g), 3, maxX-1, (maxY/10)*8-1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Members"
+		v.Editable = false
+		v.Wrap = false
+		manager.drawMembers(g)
+	}
+	return nil
+}
+
+// members is who to list for the current tab: everyone in a room, or the
+// one peer in a private conversation.
+func (manager *ChatboxManager) members() []punchy.Peer {
+	if peerName, direct := directPeer(manager.room); direct {
+		peer, ok := manager.findPeer(peerName)
+		if !ok {
+			return nil
+		}
+		return []punchy.Peer{peer}
+	}
+	return manager.chatroomClient.Peers(manager.room)
+}
+
+func (manager *ChatboxManager) drawMembers(g *gocui.Gui) {
+	v, err := g.View("member-list")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	if manager.room == "" {
+		v.Title = "Members"
+		return
+	}
+	peers := manager.members()
+	v.Title = fmt.Sprintf("Members (%d)", len(peers)+1)
+	if nick := manager.chatroomClient.RoomNick(manager.room); nick != "" {
+		fmt.Fprintf(v, "%s (you)\n", nick)
+	} else {
+		fmt.Fprintln(v, "you")
+	}
+	for _, peer := range peers {
+		fmt.Fprintln(v, peer.Name())
+		status := peerStatus(peer)
+		if idle := idleTime(peer); idle != "" {
+			status += ", idle " + idle
+		}
+		fmt.Fprintln(v, "  "+status)
+	}
+}
+
+// idleTime is how long since we last heard from a peer directly, or "" if
+// we never have.
+func idleTime(peer punchy.Peer) string {
+	if peer.LastSeen().IsZero() {
+		return ""
+	}
+	idle := time.Since(peer.LastSeen())
+	if idle < time.Minute {
+		return fmt.Sprintf("%ds", int(idle.Seconds()))
+	} else if idle < time.Hour {
+		return fmt.Sprintf("%dm", int(idle.Minutes()))
+	}
+	return fmt.Sprintf("%dh", int(idle.Hours()))
+}
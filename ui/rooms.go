@@ -0,0 +1,279 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/MerreM/lemony/chatroom/punchy"
+	"github.com/jroimartin/gocui"
+)
+
+// roomTab is everything the UI remembers about one joined room. Only the
+// active room is drawn in the chat box; the rest count unread lines.
+type roomTab struct {
+	name    string
+	history []string
+	lines   []string
+	unread  int
+	sent    map[uint32]*sentLine
+}
+
+// sentLine is a message we sent, and which peers have confirmed getting and
+// reading it.
+type sentLine struct {
+	index     int
+	text      string
+	peers     []string
+	delivered map[string]bool
+	read      map[string]bool
+}
+
+// addPeer lists a peer against the line the first time we hear about it.
+func (sent *sentLine) addPeer(peer string) {
+	for _, other := range sent.peers {
+		if other == peer {
+			return
+		}
+	}
+	sent.peers = append(sent.peers, peer)
+}
+
+// String is the line with its marks, shown as
+// You said "hi" [✓✓ alice ✓ bob ✗ carol] for read, delivered and failed.
+func (sent *sentLine) String() string {
+	if len(sent.peers) == 0 {
+		return sent.text
+	}
+	var marks bytes.Buffer
+	for _, peer := range sent.peers {
+		if sent.read[peer] {
+			fmt.Fprintf(&marks, " ✓✓ %s", peer)
+		} else if sent.delivered[peer] {
+			fmt.Fprintf(&marks, " ✓ %s", peer)
+		} else {
+			fmt.Fprintf(&marks, " ✗ %s", peer)
+		}
+	}
+	return fmt.Sprintf("%s [%s]", sent.text, strings.TrimPrefix(marks.String(), " "))
+}
+
+// directPeer reports whether a tab is a private conversation, and with whom.
+func directPeer(name string) (string, bool) {
+	if !strings.HasPrefix(name, "@") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, "@"), true
+}
+
+// The room methods below touch manager state and views, so they must only be
+// called from inside g.Execute or a keybinding handler.
+
+func (manager *ChatboxManager) addRoom(g *gocui.Gui, name string) *roomTab {
+	if tab := manager.rooms[name]; tab != nil {
+		return tab
+	}
+	tab := &roomTab{name: name}
+	manager.rooms[name] = tab
+	manager.order = append(manager.order, name)
+	if manager.room == "" {
+		manager.room = name
+	}
+	manager.redraw(g)
+	return tab
+}
+
+func (manager *ChatboxManager) removeRoom(g *gocui.Gui, name string) {
+	if manager.rooms[name] == nil {
+		return
+	}
+	delete(manager.rooms, name)
+	for i, other := range manager.order {
+		if other == name {
+			manager.order = append(manager.order[:i], manager.order[i+1:]...)
+			break
+		}
+	}
+	if manager.room == name {
+		manager.room = ""
+		if len(manager.order) > 0 {
+			manager.room = manager.order[0]
+		}
+	}
+	manager.redraw(g)
+}
+
+func (manager *ChatboxManager) switchRoom(g *gocui.Gui, offset int) {
+	if len(manager.order) == 0 {
+		return
+	}
+	current := 0
+	for i, name := range manager.order {
+		if name == manager.room {
+			current = i
+		}
+	}
+	next := (current + offset + len(manager.order)) % len(manager.order)
+	manager.room = manager.order[next]
+	manager.redraw(g)
+}
+
+func (manager *ChatboxManager) nextRoom(g *gocui.Gui, v *gocui.View) error {
+	manager.switchRoom(g, 1)
+	return nil
+}
+
+func (manager *ChatboxManager) previousRoom(g *gocui.Gui, v *gocui.View) error {
+	manager.switchRoom(g, -1)
+	return nil
+}
+
+// appendLine adds a line to a room, drawing it straight away if the room is
+// the one on screen.
+func (manager *ChatboxManager) appendLine(g *gocui.Gui, roomName, line string) {
+	tab := manager.addRoom(g, roomName)
+	tab.lines = append(tab.lines, line)
+	if roomName != manager.room {
+		tab.unread++
+		manager.drawTabs(g)
+		return
+	}
+	v, err := g.View("chat-box")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Fprintln(v, line)
+	manager.readCurrent()
+}
+
+// systemLine shows feedback from commands in the current room, or straight
+// in the chat box if we are not in one.
+func (manager *ChatboxManager) systemLine(g *gocui.Gui, line string) {
+	if manager.room != "" {
+		manager.appendLine(g, manager.room, "* "+line)
+		return
+	}
+	v, err := g.View("chat-box")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Fprintln(v, "* "+line)
+}
+
+// trackSent remembers the line just added to a room so its delivery marks
+// can be filled in as peers acknowledge it.
+func (manager *ChatboxManager) trackSent(g *gocui.Gui, roomName string, id uint32) {
+	tab := manager.addRoom(g, roomName)
+	if tab.sent == nil {
+		tab.sent = make(map[uint32]*sentLine)
+	}
+	index := len(tab.lines) - 1
+	tab.sent[id] = &sentLine{index, tab.lines[index], nil, make(map[string]bool), make(map[string]bool)}
+}
+
+// markDelivery updates a sent line with whether one peer got it.
+func (manager *ChatboxManager) markDelivery(g *gocui.Gui, delivery punchy.Delivery) {
+	tab := manager.rooms[delivery.Room]
+	if tab == nil || tab.sent[delivery.ID] == nil {
+		return
+	}
+	sent := tab.sent[delivery.ID]
+	sent.addPeer(delivery.Peer)
+	sent.delivered[delivery.Peer] = delivery.Delivered
+	if sent.index < len(tab.lines) {
+		tab.lines[sent.index] = sent.String()
+	}
+	if delivery.Room == manager.room {
+		manager.drawChat(g)
+	}
+}
+
+// markRead updates every line we sent to a room, up to the one a peer has
+// read, to show they have read it.
+func (manager *ChatboxManager) markRead(g *gocui.Gui, receipt punchy.Receipt) {
+	tab := manager.rooms[receipt.Room]
+	if tab == nil {
+		return
+	}
+	for id, sent := range tab.sent {
+		if id > receipt.ID || sent.read[receipt.Peer] {
+			continue
+		}
+		sent.addPeer(receipt.Peer)
+		sent.delivered[receipt.Peer] = true
+		sent.read[receipt.Peer] = true
+		if sent.index < len(tab.lines) {
+			tab.lines[sent.index] = sent.String()
+		}
+	}
+	if receipt.Room == manager.room {
+		manager.drawChat(g)
+	}
+}
+
+// appendHistory adds a line of server-side history. History arrives after
+// we have joined, so the room is redrawn with it above the live lines.
+func (manager *ChatboxManager) appendHistory(g *gocui.Gui, roomName, line string) {
+	tab := manager.addRoom(g, roomName)
+	tab.history = append(tab.history, line)
+	if roomName == manager.room {
+		manager.drawChat(g)
+	}
+}
+
+func (manager *ChatboxManager) redraw(g *gocui.Gui) {
+	manager.drawChat(g)
+	manager.drawTabs(g)
+	manager.drawMembers(g)
+	manager.drawTyping(g)
+	manager.readCurrent()
+}
+
+func (manager *ChatboxManager) drawChat(g *gocui.Gui) {
+	v, err := g.View("chat-box")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	tab := manager.rooms[manager.room]
+	if tab == nil {
+		v.Title = "Chat Room"
+		return
+	}
+	tab.unread = 0
+	v.Title = "Chat Room: " + tab.name
+	if peerName, ok := directPeer(tab.name); ok {
+		v.Title = "Private: " + peerName
+	}
+	for _, line := range tab.history {
+		fmt.Fprintln(v, line)
+	}
+	if len(tab.history) > 0 {
+		fmt.Fprintln(v, "---")
+	}
+	for _, line := range tab.lines {
+		fmt.Fprintln(v, line)
+	}
+}
+
+func (manager *ChatboxManager) drawTabs(g *gocui.Gui) {
+	v, err := g.View("tab-bar")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	var bar bytes.Buffer
+	for _, name := range manager.order {
+		tab := manager.rooms[name]
+		if name == manager.room {
+			fmt.Fprintf(&bar, "[%s] ", name)
+		} else if tab.unread > 0 {
+			fmt.Fprintf(&bar, " %s (%d) ", name, tab.unread)
+		} else {
+			fmt.Fprintf(&bar, " %s  ", name)
+		}
+	}
+	fmt.Fprint(v, bar.String())
+}
@@ -0,0 +1,100 @@
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MerreM/lemony/chatroom/punchy"
+	"github.com/jroimartin/gocui"
+)
+
+// typingTimeout is how long a peer is shown as typing after their last
+// signal. Signals come at most every few seconds while they type, so this
+// is long enough to bridge the gap between two.
+const typingTimeout = 6 * time.Second
+
+func (manager *ChatboxManager) typingLayout(g *gocui.Gui) error {
+	maxX, maxY := g.Size()
+	if v, err := g.SetView("typing-bar", 0, (maxY/10)*8-1, maxX-sidebarWidth(g)-1, ((maxY/10)*8)+1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Frame = false
+		v.Editable = false
+		v.Wrap = false
+		manager.drawTyping(g)
+	}
+	return nil
+}
+
+// edit is the input box's editor. As well as editing, it tells the current
+// room we are typing whenever the box holds a message rather than a command.
+// The client keeps that to one signal every few seconds.
+func (manager *ChatboxManager) edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	text := strings.TrimSpace(v.Buffer())
+	if manager.room == "" || text == "" || strings.HasPrefix(text, "/") {
+		return
+	}
+	err := manager.chatroomClient.SendTyping(manager.room)
+	if err != nil {
+		log.Warningf("Typing in %s: %v", manager.room, err)
+	}
+}
+
+// noteTyping records a peer starting or stopping typing in a room.
+func (manager *ChatboxManager) noteTyping(g *gocui.Gui, typing punchy.TypingEvent) {
+	if typing.Stopped {
+		delete(manager.typing[typing.Room], typing.Peer)
+	} else {
+		if manager.typing[typing.Room] == nil {
+			manager.typing[typing.Room] = make(map[string]time.Time)
+		}
+		manager.typing[typing.Room][typing.Peer] = time.Now()
+	}
+	if typing.Room == manager.room {
+		manager.drawTyping(g)
+	}
+}
+
+// drawTyping shows who is typing in the current room, forgetting anyone
+// who has not signalled for a while.
+func (manager *ChatboxManager) drawTyping(g *gocui.Gui) {
+	v, err := g.View("typing-bar")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	names := make([]string, 0)
+	for name, since := range manager.typing[manager.room] {
+		if time.Since(since) > typingTimeout {
+			delete(manager.typing[manager.room], name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+	case 1:
+		fmt.Fprintf(v, "%s is typing…", names[0])
+	case 2:
+		fmt.Fprintf(v, "%s and %s are typing…", names[0], names[1])
+	default:
+		fmt.Fprintf(v, "%d people are typing…", len(names))
+	}
+}
+
+// readCurrent tells the peers in the room on screen that we have read what
+// they sent. It is called whenever new lines are drawn there.
+func (manager *ChatboxManager) readCurrent() {
+	if manager.room == "" {
+		return
+	}
+	err := manager.chatroomClient.MarkRead(manager.room)
+	if err != nil {
+		log.Warningf("Marking %s read: %v", manager.room, err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/MerreM/lemony/chatroom/punchy"
 	"github.com/jroimartin/gocui"
@@ -37,8 +38,12 @@ var (
 type ChatboxManager struct {
 	chatroomClient *punchy.Client
 	room           string
-	input          chan string
-	output         chan string
+	input          chan punchy.DisplayMessage
+	output         chan punchy.ChatMessage
+	rooms          map[string]*roomTab
+	order          []string
+	nextID         uint32
+	typing         map[string]map[string]time.Time
 }
 
 func nextView(g *gocui.Gui, v *gocui.View) error {
@@ -53,6 +58,14 @@ func nextView(g *gocui.Gui, v *gocui.View) error {
 	return nil
 }
 
+// tab completes a command in the input box, or moves to the next view.
+func (manager *ChatboxManager) tab(g *gocui.Gui, v *gocui.View) error {
+	if v != nil && v.Name() == "input-box" && manager.completeCommand(g, v) {
+		return nil
+	}
+	return nextView(g, v)
+}
+
 func (manager *ChatboxManager) processMessage(g *gocui.Gui, v *gocui.View) error {
 	g.Execute(func(g *gocui.Gui) error {
 		inputBox, err := g.View("input-box")
@@ -63,21 +76,67 @@ func (manager *ChatboxManager) processMessage(g *gocui.Gui, v *gocui.View) error
 		data_str := string(data)
 		data_str = strings.TrimSuffix(data_str, "\n")
 		data_str = strings.TrimSuffix(data_str, " ")
-		if strings.HasPrefix(data_str, "/") {
-			log.Info("Handle Command")
-		} else {
-			log.Info("Send message to room")
-			manager.output <- data_str
-			manager.input <- fmt.Sprintf("You said \"%s\" to room ??", data_str)
-		}
 		inputBox.Clear()
 		inputBox.Rewind()
 		inputBox.SetCursor(0, 0)
+		if strings.HasPrefix(data_str, "/") {
+			return manager.runCommand(g, data_str)
+		} else if manager.room != "" {
+			manager.sendToRoom(g, data_str)
+		}
 		return nil
 	})
 	return nil
 }
 
+// sendToRoom sends a line to everyone in the current room, or to one peer if
+// the current tab is a private conversation.
+func (manager *ChatboxManager) sendToRoom(g *gocui.Gui, text string) {
+	log.Info("Send message to room")
+	if peerName, ok := directPeer(manager.room); ok {
+		err := manager.sendPrivate(g, peerName, text)
+		if err != nil {
+			manager.systemLine(g, err.Error())
+		}
+		return
+	}
+	manager.nextID++
+	message := punchy.ChatMessage{}
+	message.Room = manager.room
+	message.Message = text
+	message.ID = manager.nextID
+	manager.output <- message
+	manager.echo(g, manager.room, text, message.ID)
+}
+
+// sendPrivate sends a line to one peer and files it under their tab.
+func (manager *ChatboxManager) sendPrivate(g *gocui.Gui, peerName, text string) error {
+	manager.nextID++
+	err := manager.chatroomClient.SendPrivate(peerName, text, manager.nextID)
+	if err != nil {
+		return err
+	}
+	manager.echo(g, punchy.DirectRoom(peerName), text, manager.nextID)
+	return nil
+}
+
+// echo shows a line we sent, ready for its delivery marks.
+func (manager *ChatboxManager) echo(g *gocui.Gui, roomName, text string, id uint32) {
+	line := fmt.Sprintf("You said \"%s\"", text)
+	if strings.HasPrefix(text, "/me ") {
+		line = punchy.FormatChat(manager.nickname(), text)
+	}
+	manager.appendLine(g, roomName, line)
+	manager.trackSent(g, roomName, id)
+}
+
+func (manager *ChatboxManager) nickname() string {
+	if nick := manager.chatroomClient.Nick(); nick != "" {
+		return nick
+	}
+	return "you"
+}
+
 func setCurrentViewOnTop(g *gocui.Gui, name string) (*gocui.View, error) {
 	if _, err := g.SetCurrentView(name); err != nil {
 		return nil, err
@@ -85,9 +144,22 @@ func setCurrentViewOnTop(g *gocui.Gui, name string) (*gocui.View, error) {
 	return g.SetViewOnTop(name)
 }
 
+func (manager *ChatboxManager) tabBarLayout(g *gocui.Gui) error {
+	maxX, _ := g.Size()
+	if v, err := g.SetView("tab-bar", 0, 0, maxX-1, 2); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Rooms (Ctrl+N / Ctrl+P)"
+		v.Editable = false
+		manager.drawTabs(g)
+	}
+	return nil
+}
+
 func (manager *ChatboxManager) debugBoxLayout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
-	if v, err := g.SetView("console-box", 0, 0, maxX-1, (maxY/10)*8); err != nil {
+	if v, err := g.SetView("console-box", 0, 3, maxX-1, (maxY/10)*8); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -108,7 +180,7 @@ func (manager *ChatboxManager) debugBoxLayout(g *gocui.Gui) error {
 
 func (manager *ChatboxManager) chatBoxLayout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
-	if v, err := g.SetView("chat-box", 0, 0, maxX-1, (maxY/10)*8); err != nil {
+	if v, err := g.SetView("chat-box", 0, 3, maxX-sidebarWidth(g)-1, (maxY/10)*8-1); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -116,6 +188,7 @@ func (manager *ChatboxManager) chatBoxLayout(g *gocui.Gui) error {
 		v.Editable = false
 		v.Wrap = true
 		v.Autoscroll = true
+		manager.drawChat(g)
 	}
 	return nil
 }
@@ -128,10 +201,11 @@ func (manager *ChatboxManager) inputLayout(g *gocui.Gui) error {
 		}
 		v.Title = "Input"
 		v.Editable = true
+		v.Editor = gocui.EditorFunc(manager.edit)
 		if _, err = setCurrentViewOnTop(g, "input-box"); err != nil {
 			return err
 		}
-		if err := g.SetKeybinding("", gocui.KeyTab, gocui.ModNone, nextView); err != nil {
+		if err := g.SetKeybinding("", gocui.KeyTab, gocui.ModNone, manager.tab); err != nil {
 			log.Critical(err)
 		}
 	}
@@ -149,7 +223,12 @@ func (manager *ChatboxManager) inputLayout(g *gocui.Gui) error {
 }
 
 func (manager *ChatboxManager) Layout(g *gocui.Gui) error {
-	err := manager.debugBoxLayout(g)
+	err := manager.tabBarLayout(g)
+	if err != nil {
+		return err
+	}
+
+	err = manager.debugBoxLayout(g)
 	if err != nil {
 		return err
 	}
@@ -158,6 +237,14 @@ func (manager *ChatboxManager) Layout(g *gocui.Gui) error {
 	if err != nil {
 		return err
 	}
+	err = manager.memberListLayout(g)
+	if err != nil {
+		return err
+	}
+	err = manager.typingLayout(g)
+	if err != nil {
+		return err
+	}
 	err = manager.inputLayout(g)
 	if err != nil {
 		return err
@@ -166,30 +253,113 @@ func (manager *ChatboxManager) Layout(g *gocui.Gui) error {
 	return nil
 }
 
-func quit(g *gocui.Gui, v *gocui.View) error {
+func (manager *ChatboxManager) joinRoom(g *gocui.Gui, roomName string) {
+	if roomName == "" {
+		return
+	}
+	manager.addRoom(g, roomName)
+	manager.room = roomName
+	manager.redraw(g)
+	go manager.connect(g, roomName)
+}
+
+// connect joins a room in the background and reports if that fails.
+func (manager *ChatboxManager) connect(g *gocui.Gui, roomName string) {
+	err := manager.chatroomClient.ConnectToRoom(roomName)
+	if err != nil {
+		g.Execute(func(g *gocui.Gui) error {
+			manager.systemLine(g, fmt.Sprintf("Could not join %s: %v", roomName, err))
+			return nil
+		})
+	}
+}
+
+func (manager *ChatboxManager) leaveRoom(g *gocui.Gui) {
+	if manager.room == "" {
+		return
+	}
+	if _, ok := directPeer(manager.room); !ok {
+		err := manager.chatroomClient.LeaveRoom(manager.room)
+		if err != nil {
+			log.Warningf("Leaving %s: %v", manager.room, err)
+		}
+		log.Infof("You left room %s", manager.room)
+	}
+	manager.removeRoom(g, manager.room)
+}
+
+func (manager *ChatboxManager) quit(g *gocui.Gui, v *gocui.View) error {
+	for _, room := range manager.chatroomClient.Rooms() {
+		err := manager.chatroomClient.LeaveRoom(room)
+		if err != nil {
+			log.Warningf("Leaving %s: %v", room, err)
+		}
+	}
 	return gocui.ErrQuit
 }
 
 func initChatRoomManager(chatroomClient *punchy.Client) *ChatboxManager {
-	input := make(chan string)
-	output := make(chan string)
+	input := make(chan punchy.DisplayMessage)
+	output := make(chan punchy.ChatMessage)
 
-	return &ChatboxManager{chatroomClient, "", input, output}
+	return &ChatboxManager{chatroomClient, "", input, output, make(map[string]*roomTab), nil, 0, make(map[string]map[string]time.Time)}
 }
 
+// updateChatMessages hands messages from the client to the UI goroutine,
+// which files them under their room.
 func (manager *ChatboxManager) updateChatMessages(g *gocui.Gui) {
+	refresh := time.NewTicker(memberRefresh)
+	defer refresh.Stop()
 	for {
-		message := <-manager.input
-		g.Execute(func(g *gocui.Gui) error {
-			v, err := g.View("chat-box")
-			v.Write([]byte(message + "\n"))
-			if err != nil {
-				log.Error(err)
-				return err
-			}
-			return nil
-
-		})
+		select {
+		case <-manager.chatroomClient.Done():
+			return
+		case <-manager.chatroomClient.Members():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.drawMembers(g)
+				return nil
+			})
+		case <-refresh.C:
+			g.Execute(func(g *gocui.Gui) error {
+				manager.drawMembers(g)
+				manager.drawTyping(g)
+				return nil
+			})
+		case typing := <-manager.chatroomClient.Typing():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.noteTyping(g, typing)
+				return nil
+			})
+		case receipt := <-manager.chatroomClient.Receipts():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.markRead(g, receipt)
+				return nil
+			})
+		case message := <-manager.input:
+			g.Execute(func(g *gocui.Gui) error {
+				if message.Room == "" {
+					manager.systemLine(g, message.Text)
+				} else {
+					manager.appendLine(g, message.Room, message.Text)
+				}
+				return nil
+			})
+		case message := <-manager.chatroomClient.History():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.appendHistory(g, message.Room, message.Text)
+				return nil
+			})
+		case delivery := <-manager.chatroomClient.Deliveries():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.markDelivery(g, delivery)
+				return nil
+			})
+		case err := <-manager.chatroomClient.Errors():
+			g.Execute(func(g *gocui.Gui) error {
+				manager.systemLine(g, err.Error())
+				return nil
+			})
+		}
 	}
 }
 
@@ -205,12 +375,42 @@ func toggleDebug(g *gocui.Gui, v *gocui.View) error {
 		if err != nil {
 			return err
 		}
+		_, err = g.SetViewOnTop("member-list")
+		if err != nil {
+			return err
+		}
+		_, err = g.SetViewOnTop("typing-bar")
+		if err != nil {
+			return err
+		}
 		debugView = false
 	}
 	return nil
 }
 
-func InitUi(chatroomClient *punchy.Client) {
+// Preferences are the user's choices about how the UI looks.
+type Preferences struct {
+	// Console starts with the log console showing instead of the chat.
+	Console bool
+	// Highlight is the colour of the focused view: black, red, green,
+	// yellow, blue, magenta, cyan or white.
+	Highlight string
+}
+
+var colours = map[string]gocui.Attribute{
+	"black":   gocui.ColorBlack,
+	"red":     gocui.ColorRed,
+	"green":   gocui.ColorGreen,
+	"yellow":  gocui.ColorYellow,
+	"blue":    gocui.ColorBlue,
+	"magenta": gocui.ColorMagenta,
+	"cyan":    gocui.ColorCyan,
+	"white":   gocui.ColorWhite,
+}
+
+// InitUi runs the chat UI, joining each of the given rooms. More can be
+// joined with /join.
+func InitUi(chatroomClient *punchy.Client, prefs Preferences, rooms ...string) {
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
 		log.Critical(err)
@@ -220,20 +420,35 @@ func InitUi(chatroomClient *punchy.Client) {
 	g.Highlight = true
 	g.Cursor = true
 	g.SelFgColor = gocui.ColorGreen
+	if colour, ok := colours[prefs.Highlight]; ok {
+		g.SelFgColor = colour
+	}
 
 	manager := initChatRoomManager(chatroomClient)
 	log.Info("Startup")
-	chatroomClient.StartUp(manager.input)
+	chatroomClient.StartUp(manager.input, manager.output)
 	log.Info("Connecting")
-	go chatroomClient.ConnectToRoom(manager.output, "Hello")
+	for _, room := range rooms {
+		manager.addRoom(g, room)
+	}
+	go func() {
+		for _, room := range rooms {
+			manager.connect(g, room)
+		}
+	}()
 	log.Info("Manager setting")
 	g.SetManager(manager)
 
 	go manager.updateChatMessages(g)
+	if prefs.Console {
+		g.Execute(func(g *gocui.Gui) error {
+			return toggleDebug(g, nil)
+		})
+	}
 
 	log.Info("Manager set")
 
-	if err := g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, quit); err != nil {
+	if err := g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, manager.quit); err != nil {
 		log.Critical(err)
 	}
 
@@ -241,6 +456,14 @@ func InitUi(chatroomClient *punchy.Client) {
 		log.Critical(err)
 	}
 
+	if err := g.SetKeybinding("", gocui.KeyCtrlN, gocui.ModNone, manager.nextRoom); err != nil {
+		log.Critical(err)
+	}
+
+	if err := g.SetKeybinding("", gocui.KeyCtrlP, gocui.ModNone, manager.previousRoom); err != nil {
+		log.Critical(err)
+	}
+
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
 		log.Critical(err)
 	}